@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxActivitySize caps uploaded activity files. FIT files are small but a
+// long GPX track with extensions can run to several megabytes.
+const maxActivitySize = 20 << 20
+
+// activityWorkoutName is the workout type imported activities are logged as.
+const activityWorkoutName = "Cardio"
+
+// cardioWorkout returns the user's Cardio workout type, creating it if the
+// user deleted or renamed the seeded one.
+func cardioWorkout(tx *gorm.DB, userID uint) (*Workout, error) {
+	return findOrCreateWorkout(tx, userID, activityWorkoutName)
+}
+
+// readActivityUpload returns the uploaded file, either the "file" field of a
+// multipart form or the raw request body.
+func readActivityUpload(c *gin.Context) ([]byte, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxActivitySize)
+
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	return io.ReadAll(c.Request.Body)
+}
+
+func postActivity(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		data, err := readActivityUpload(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "could not read activity file: " + err.Error()})
+			return
+		}
+		if len(data) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "activity file is empty"})
+			return
+		}
+
+		summary, format, err := parseActivity(data)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+
+		loc := userLocation(user)
+		start := summary.Start.In(loc)
+		day := dateIn(start, loc)
+
+		session := Session{StartTime: &start, Source: format}
+		if minutes := int(math.Round(summary.Duration.Minutes())); minutes > 0 {
+			session.DurationMinutes = &minutes
+		}
+		if summary.DistanceMeters > 0 {
+			distance := math.Round(summary.DistanceMeters*10) / 10
+			session.DistanceMeters = &distance
+		}
+		if summary.ElevationGainMeters > 0 {
+			gain := math.Round(summary.ElevationGainMeters*10) / 10
+			session.ElevationGainMeters = &gain
+		}
+		session.AvgHeartRate = summary.AvgHeartRate
+
+		// The activity goes on the entry for its start day, which is
+		// created if the day wasn't logged yet
+		created := false
+		duplicate := false
+		err = db.Transaction(func(tx *gorm.DB) error {
+			workout, err := cardioWorkout(tx, user.ID)
+			if err != nil {
+				return err
+			}
+			session.WorkoutID = &workout.ID
+
+			entry := Entry{UserID: user.ID, Date: day, Visited: true}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry)
+			if result.Error != nil {
+				return result.Error
+			}
+			created = result.RowsAffected > 0
+			if !created {
+				if err := onDay(tx, user.ID, day).First(&entry).Error; err != nil {
+					return err
+				}
+
+				// Uploading the same file twice shouldn't log it twice
+				var count int64
+				if err := tx.Model(&Session{}).Where("entry_id = ? AND start_time = ?", entry.ID, start).Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					duplicate = true
+					return nil
+				}
+				if !entry.Visited {
+					if err := tx.Model(&entry).Update("visited", true).Error; err != nil {
+						return err
+					}
+				}
+			}
+
+			session.EntryID = entry.ID
+			if err := tx.Create(&session).Error; err != nil {
+				return err
+			}
+			return tx.Preload("Workout").First(&session, session.ID).Error
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if duplicate {
+			c.JSON(http.StatusConflict, gin.H{"error": "a session starting at " + start.Format(time.RFC3339) + " already exists"})
+			return
+		}
+
+		message := "session added"
+		if created {
+			message = "entry added"
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"message": message,
+			"date":    day.Format("2006-01-02"),
+			"session": toSessionResponse(session, loc),
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"math"
+	"time"
+)
+
+// activitySummary is what gets stored from an uploaded activity file.
+type activitySummary struct {
+	Start               time.Time
+	Duration            time.Duration
+	DistanceMeters      float64
+	ElevationGainMeters float64
+	AvgHeartRate        *int
+}
+
+// trackPoint is a sample along a recorded activity. Distance is the
+// cumulative distance when the file records it.
+type trackPoint struct {
+	Time      time.Time
+	Lat, Lon  *float64
+	Elevation *float64
+	HeartRate *int
+	Distance  *float64
+}
+
+const earthRadiusMeters = 6371000
+
+// haversine returns the great-circle distance between two coordinates.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// summarizeTrack works out an activity summary from its samples.
+func summarizeTrack(points []trackPoint) (*activitySummary, error) {
+	var timed []trackPoint
+	for _, p := range points {
+		if !p.Time.IsZero() {
+			timed = append(timed, p)
+		}
+	}
+	if len(timed) == 0 {
+		return nil, errors.New("activity has no timestamped track points")
+	}
+
+	summary := &activitySummary{
+		Start:    timed[0].Time,
+		Duration: timed[len(timed)-1].Time.Sub(timed[0].Time),
+	}
+
+	var hrTotal, hrCount int
+	var lastElevation *float64
+	var lastLat, lastLon *float64
+	var recordedDistance *float64
+	for _, p := range timed {
+		if p.Lat != nil && p.Lon != nil {
+			if lastLat != nil {
+				summary.DistanceMeters += haversine(*lastLat, *lastLon, *p.Lat, *p.Lon)
+			}
+			lastLat, lastLon = p.Lat, p.Lon
+		}
+		if p.Distance != nil {
+			recordedDistance = p.Distance
+		}
+		if p.Elevation != nil {
+			if lastElevation != nil && *p.Elevation > *lastElevation {
+				summary.ElevationGainMeters += *p.Elevation - *lastElevation
+			}
+			lastElevation = p.Elevation
+		}
+		if p.HeartRate != nil && *p.HeartRate > 0 {
+			hrTotal += *p.HeartRate
+			hrCount++
+		}
+	}
+
+	// Prefer the device's own distance over one computed from coordinates
+	if recordedDistance != nil {
+		summary.DistanceMeters = *recordedDistance
+	}
+	if hrCount > 0 {
+		hr := int(float64(hrTotal)/float64(hrCount) + 0.5)
+		summary.AvgHeartRate = &hr
+	}
+
+	return summary, nil
+}
+
+// parseGPX summarizes the tracks of a GPX file. Heart rate is read from
+// Garmin's TrackPointExtension.
+func parseGPX(data []byte) (*activitySummary, error) {
+	var doc struct {
+		XMLName xml.Name `xml:"gpx"`
+		Tracks  []struct {
+			Segments []struct {
+				Points []struct {
+					Lat       float64  `xml:"lat,attr"`
+					Lon       float64  `xml:"lon,attr"`
+					Elevation *float64 `xml:"ele"`
+					Time      string   `xml:"time"`
+					HeartRate *int     `xml:"extensions>TrackPointExtension>hr"`
+				} `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.New("invalid GPX file")
+	}
+
+	var points []trackPoint
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, pt := range seg.Points {
+				t, err := time.Parse(time.RFC3339, pt.Time)
+				if err != nil {
+					continue
+				}
+				lat, lon := pt.Lat, pt.Lon
+				points = append(points, trackPoint{
+					Time:      t,
+					Lat:       &lat,
+					Lon:       &lon,
+					Elevation: pt.Elevation,
+					HeartRate: pt.HeartRate,
+				})
+			}
+		}
+	}
+
+	return summarizeTrack(points)
+}
+
+// parseTCX summarizes the laps of a TCX file, using the lap totals where
+// present and the track points for elevation gain and heart rate.
+func parseTCX(data []byte) (*activitySummary, error) {
+	var doc struct {
+		XMLName    xml.Name `xml:"TrainingCenterDatabase"`
+		Activities []struct {
+			Laps []struct {
+				StartTime        string   `xml:"StartTime,attr"`
+				TotalTimeSeconds float64  `xml:"TotalTimeSeconds"`
+				DistanceMeters   *float64 `xml:"DistanceMeters"`
+				AvgHeartRate     *int     `xml:"AverageHeartRateBpm>Value"`
+				Trackpoints      []struct {
+					Time      string   `xml:"Time"`
+					Lat       *float64 `xml:"Position>LatitudeDegrees"`
+					Lon       *float64 `xml:"Position>LongitudeDegrees"`
+					Altitude  *float64 `xml:"AltitudeMeters"`
+					Distance  *float64 `xml:"DistanceMeters"`
+					HeartRate *int     `xml:"HeartRateBpm>Value"`
+				} `xml:"Track>Trackpoint"`
+			} `xml:"Lap"`
+		} `xml:"Activities>Activity"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.New("invalid TCX file")
+	}
+
+	var points []trackPoint
+	var start time.Time
+	var duration time.Duration
+	var distance, hrWeighted, hrSeconds float64
+	lapTotals := true
+	for _, activity := range doc.Activities {
+		for _, lap := range activity.Laps {
+			if t, err := time.Parse(time.RFC3339, lap.StartTime); err == nil && (start.IsZero() || t.Before(start)) {
+				start = t
+			}
+			duration += time.Duration(lap.TotalTimeSeconds * float64(time.Second))
+			if lap.DistanceMeters != nil {
+				distance += *lap.DistanceMeters
+			} else {
+				lapTotals = false
+			}
+			if lap.AvgHeartRate != nil {
+				hrWeighted += float64(*lap.AvgHeartRate) * lap.TotalTimeSeconds
+				hrSeconds += lap.TotalTimeSeconds
+			}
+
+			for _, tp := range lap.Trackpoints {
+				t, err := time.Parse(time.RFC3339, tp.Time)
+				if err != nil {
+					continue
+				}
+				points = append(points, trackPoint{
+					Time:      t,
+					Lat:       tp.Lat,
+					Lon:       tp.Lon,
+					Elevation: tp.Altitude,
+					HeartRate: tp.HeartRate,
+					Distance:  tp.Distance,
+				})
+			}
+		}
+	}
+
+	summary, err := summarizeTrack(points)
+	if err != nil {
+		// Laps without track points still carry the totals
+		if start.IsZero() {
+			return nil, errors.New("TCX file has no laps")
+		}
+		summary = &activitySummary{}
+	}
+	if !start.IsZero() {
+		summary.Start = start
+	}
+	if duration > 0 {
+		summary.Duration = duration
+	}
+	if lapTotals && distance > 0 {
+		summary.DistanceMeters = distance
+	}
+	if hrSeconds > 0 {
+		hr := int(hrWeighted/hrSeconds + 0.5)
+		summary.AvgHeartRate = &hr
+	}
+
+	return summary, nil
+}
+
+// parseActivity detects the format of an activity file from its contents
+// and summarizes it.
+func parseActivity(data []byte) (*activitySummary, string, error) {
+	if len(data) >= 12 && string(data[8:12]) == ".FIT" {
+		summary, err := parseFIT(data)
+		return summary, "fit", err
+	}
+
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	switch {
+	case bytes.Contains(head, []byte("<gpx")):
+		summary, err := parseGPX(data)
+		return summary, "gpx", err
+	case bytes.Contains(head, []byte("<TrainingCenterDatabase")):
+		summary, err := parseTCX(data)
+		return summary, "tcx", err
+	}
+	return nil, "", errors.New("unsupported file, upload a GPX, TCX or FIT activity")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkSummary compares summaries, allowing distances computed from
+// coordinates to be off by a meter.
+func checkSummary(t *testing.T, got, want *activitySummary) {
+	t.Helper()
+	if !got.Start.Equal(want.Start) {
+		t.Errorf("start = %v, want %v", got.Start, want.Start)
+	}
+	if got.Duration != want.Duration {
+		t.Errorf("duration = %v, want %v", got.Duration, want.Duration)
+	}
+	if math.Abs(got.DistanceMeters-want.DistanceMeters) > 1 {
+		t.Errorf("distance = %.1f, want %.1f", got.DistanceMeters, want.DistanceMeters)
+	}
+	if math.Abs(got.ElevationGainMeters-want.ElevationGainMeters) > 0.01 {
+		t.Errorf("elevation gain = %.2f, want %.2f", got.ElevationGainMeters, want.ElevationGainMeters)
+	}
+	switch {
+	case (got.AvgHeartRate == nil) != (want.AvgHeartRate == nil):
+		t.Errorf("avg heart rate = %v, want %v", got.AvgHeartRate, want.AvgHeartRate)
+	case got.AvgHeartRate != nil && *got.AvgHeartRate != *want.AvgHeartRate:
+		t.Errorf("avg heart rate = %d, want %d", *got.AvgHeartRate, *want.AvgHeartRate)
+	}
+}
+
+func TestParseActivity(t *testing.T) {
+	start := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		file   string
+		format string
+		want   *activitySummary
+	}{
+		{
+			// Distance from coordinates, 0.002° of longitude on the equator
+			file:   "run.gpx",
+			format: "gpx",
+			want: &activitySummary{
+				Start:               start,
+				Duration:            2 * time.Minute,
+				DistanceMeters:      222.4,
+				ElevationGainMeters: 5,
+				AvgHeartRate:        ptr(110),
+			},
+		},
+		{
+			// Lap totals, with heart rate weighted by lap time
+			file:   "ride.tcx",
+			format: "tcx",
+			want: &activitySummary{
+				Start:               start,
+				Duration:            15 * time.Minute,
+				DistanceMeters:      3000,
+				ElevationGainMeters: 25,
+				AvgHeartRate:        ptr(150),
+			},
+		},
+		{
+			file:   "activity.fit",
+			format: "fit",
+			want: &activitySummary{
+				Start:               start,
+				Duration:            30 * time.Minute,
+				DistanceMeters:      5000,
+				ElevationGainMeters: 42,
+				AvgHeartRate:        ptr(150),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, format, err := parseActivity(readFixture(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.format {
+				t.Errorf("format = %q, want %q", format, tt.format)
+			}
+			checkSummary(t, got, tt.want)
+		})
+	}
+}
+
+func TestParseActivityErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unsupported", `{"type": "run"}`},
+		{"invalid gpx", `<gpx><trk>`},
+		{"gpx without times", `<gpx><trk><trkseg><trkpt lat="0" lon="0"/></trkseg></trk></gpx>`},
+		{"tcx without laps", `<TrainingCenterDatabase><Activities><Activity/></Activities></TrainingCenterDatabase>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := parseActivity([]byte(tt.data)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseTCXLapsOnly(t *testing.T) {
+	data := `<TrainingCenterDatabase><Activities><Activity>
+		<Lap StartTime="2024-03-01T06:00:00Z">
+			<TotalTimeSeconds>1200</TotalTimeSeconds>
+			<DistanceMeters>4000</DistanceMeters>
+		</Lap>
+	</Activity></Activities></TrainingCenterDatabase>`
+
+	got, err := parseTCX([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSummary(t, got, &activitySummary{
+		Start:          time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC),
+		Duration:       20 * time.Minute,
+		DistanceMeters: 4000,
+	})
+}
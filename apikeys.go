@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// API key scopes. Reads need read, changes need write and managing users
+// and keys needs admin.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+var validScopes = map[string]bool{scopeRead: true, scopeWrite: true, scopeAdmin: true}
+
+// defaultScopes are given to keys created without explicit scopes.
+var defaultScopes = []string{scopeRead, scopeWrite}
+
+// apiKeyPrefixLength is how much of a key is stored in the clear, to find
+// candidates and to tell keys apart in listings.
+const apiKeyPrefixLength = 8
+
+// lastUsedResolution limits how often last_used_at is written for a busy key.
+const lastUsedResolution = time.Minute
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyPrefix(key string) string {
+	if len(key) > apiKeyPrefixLength {
+		return key[:apiKeyPrefixLength]
+	}
+	return key
+}
+
+func (k *APIKey) scopes() []string {
+	if k.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIKey generates a key for userID and returns it along with the row
+// to store, which only holds its hash.
+func newAPIKey(userID uint, name string, scopes []string, expiresAt *time.Time) (APIKey, string, error) {
+	secret, err := generateAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	return storedAPIKey(userID, name, secret, scopes, expiresAt), secret, nil
+}
+
+// storedAPIKey is the row stored for an existing key.
+func storedAPIKey(userID uint, name, secret string, scopes []string, expiresAt *time.Time) APIKey {
+	return APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    apiKeyPrefix(secret),
+		Hash:      hashAPIKey(secret),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// findAPIKey returns the usable key matching given, or nil if there is none
+// or it was revoked or has expired. Candidates are found by prefix.
+func findAPIKey(db *gorm.DB, given string, now time.Time) (*APIKey, error) {
+	if given == "" {
+		return nil, nil
+	}
+
+	var candidates []APIKey
+	if err := db.Where("prefix = ?", apiKeyPrefix(given)).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	return matchAPIKey(candidates, given, now), nil
+}
+
+// matchAPIKey returns the candidate whose hash matches given, compared in
+// constant time, unless it was revoked or has expired.
+func matchAPIKey(candidates []APIKey, given string, now time.Time) *APIKey {
+	hash := []byte(hashAPIKey(given))
+	var match *APIKey
+	for i := range candidates {
+		if subtle.ConstantTimeCompare(hash, []byte(candidates[i].Hash)) == 1 {
+			match = &candidates[i]
+		}
+	}
+
+	if match == nil || match.RevokedAt != nil || (match.ExpiresAt != nil && !now.Before(*match.ExpiresAt)) {
+		return nil
+	}
+	return match
+}
+
+// touchAPIKey records that key was used, at most once per
+// lastUsedResolution so busy keys don't write on every request.
+func touchAPIKey(db *gorm.DB, key *APIKey, now time.Time) error {
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < lastUsedResolution {
+		return nil
+	}
+	key.LastUsedAt = &now
+	return db.Model(key).UpdateColumn("last_used_at", now).Error
+}
+
+// migrateUserAPIKeys moves the plaintext keys users used to have into
+// hashed API keys, then drops the old column. The default user's key, which
+// is the deployment's API_KEY, keeps its admin rights.
+func migrateUserAPIKeys(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&User{}, "api_key") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			ID     uint
+			APIKey string
+		}
+		if err := tx.Table("users").Select("id, api_key").Where("api_key IS NOT NULL AND api_key <> ''").Scan(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			scopes := defaultScopes
+			deployment := row.APIKey == adminAPIKey()
+			if deployment {
+				scopes = []string{scopeRead, scopeWrite, scopeAdmin}
+			}
+			key := storedAPIKey(row.ID, "migrated", row.APIKey, scopes, nil)
+			key.Deployment = deployment
+			if err := tx.Create(&key).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Migrator().DropColumn(&User{}, "api_key")
+	})
+}
+
+// syncDeploymentKeys makes the deployment keys match the API_KEY in effect,
+// so a rotated API_KEY stops working as soon as the new one is in use. Keys
+// stored before they were marked are recognized by matching the current
+// API_KEY.
+func syncDeploymentKeys(db *gorm.DB) error {
+	secret := adminAPIKey()
+	hash := hashAPIKey(secret)
+	if err := db.Model(&APIKey{}).Where("hash = ? AND NOT deployment", hash).Update("deployment", true).Error; err != nil {
+		return err
+	}
+	return db.Model(&APIKey{}).Where("deployment AND hash <> ?", hash).
+		Updates(map[string]any{"hash": hash, "prefix": apiKeyPrefix(secret)}).Error
+}
+
+func toAPIKeyResponse(k APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     k.scopes(),
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		RevokedAt:  k.RevokedAt,
+		CreatedAt:  k.CreatedAt,
+	}
+}
+
+// apiKeyPayload holds the fields accepted when minting a key.
+type apiKeyPayload struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresAt     string   `json:"expires_at"`
+	ExpiresInDays *int     `json:"expires_in_days"`
+}
+
+// parse validates the payload, returning the scopes and expiry or a
+// user-facing message when it is invalid.
+func (p *apiKeyPayload) parse(now time.Time) ([]string, *time.Time, string) {
+	scopes := defaultScopes
+	if p.Scopes != nil {
+		if len(p.Scopes) == 0 {
+			return nil, nil, "scopes must not be empty"
+		}
+		seen := map[string]bool{}
+		scopes = nil
+		for _, s := range p.Scopes {
+			if !validScopes[s] {
+				return nil, nil, "unknown scope " + strconv.Quote(s) + ", use read, write or admin"
+			}
+			if !seen[s] {
+				seen[s] = true
+				scopes = append(scopes, s)
+			}
+		}
+	}
+
+	var expiresAt *time.Time
+	switch {
+	case p.ExpiresAt != "" && p.ExpiresInDays != nil:
+		return nil, nil, "set either expires_at or expires_in_days"
+	case p.ExpiresAt != "":
+		t, err := time.Parse(time.RFC3339, p.ExpiresAt)
+		if err != nil {
+			return nil, nil, "invalid expires_at format, use RFC 3339"
+		}
+		if !t.After(now) {
+			return nil, nil, "expires_at must be in the future"
+		}
+		expiresAt = &t
+	case p.ExpiresInDays != nil:
+		if *p.ExpiresInDays <= 0 {
+			return nil, nil, "expires_in_days must be positive"
+		}
+		t := now.AddDate(0, 0, *p.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	return scopes, expiresAt, ""
+}
+
+// userForID loads the user identified by the :id path parameter.
+func userForID(c *gin.Context, db *gorm.DB) (*User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return nil, false
+	}
+
+	var user User
+	if err := db.First(&user, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+
+	return &user, true
+}
+
+func getAPIKeys(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
+		user, ok := userForID(c, db)
+		if !ok {
+			return
+		}
+
+		var keys []APIKey
+		if err := db.Where("user_id = ?", user.ID).Order("id ASC").Find(&keys).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		response := []APIKeyResponse{}
+		for _, k := range keys {
+			response = append(response, toAPIKeyResponse(k))
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func postAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
+		user, ok := userForID(c, db)
+		if !ok {
+			return
+		}
+
+		var payload apiKeyPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		name := strings.TrimSpace(payload.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+			return
+		}
+		scopes, expiresAt, msg := payload.parse(time.Now())
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		key, secret, err := newAPIKey(user.ID, name, scopes, expiresAt)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if err := db.Create(&key).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		// The key is only ever returned here
+		response := toAPIKeyResponse(key)
+		response.Key = secret
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+func revokeAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
+		user, ok := userForID(c, db)
+		if !ok {
+			return
+		}
+
+		keyID, err := strconv.ParseUint(c.Param("key"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+			return
+		}
+
+		var key APIKey
+		if err := db.Where("user_id = ?", user.ID).First(&key, keyID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+				return
+			}
+			internalError(c, err)
+			return
+		}
+
+		// Revoked keys are kept so listings show when they were revoked
+		if key.RevokedAt == nil {
+			now := time.Now()
+			key.RevokedAt = &now
+			if err := db.Model(&key).Update("revoked_at", now).Error; err != nil {
+				internalError(c, err)
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, toAPIKeyResponse(key))
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStoredAPIKey(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+	expires := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := storedAPIKey(7, "laptop", secret, []string{scopeRead, scopeAdmin}, &expires)
+
+	if key.Prefix != "01234567" {
+		t.Errorf("prefix = %q, want the first 8 characters", key.Prefix)
+	}
+	if key.Hash == secret || strings.Contains(key.Hash, secret) {
+		t.Error("the key is stored in the clear")
+	}
+	if key.Hash != hashAPIKey(secret) || len(key.Hash) != 64 {
+		t.Errorf("hash = %q, want the hex SHA-256 of the key", key.Hash)
+	}
+	if key.UserID != 7 || key.Name != "laptop" || key.ExpiresAt != &expires {
+		t.Errorf("key = %+v, want user 7's laptop key", key)
+	}
+	if got := key.scopes(); !slices.Equal(got, []string{scopeRead, scopeAdmin}) {
+		t.Errorf("scopes = %q, want read and admin", got)
+	}
+
+	if hashAPIKey(secret) == hashAPIKey(secret+"0") {
+		t.Error("different keys hash the same")
+	}
+	if got := apiKeyPrefix("short"); got != "short" {
+		t.Errorf("prefix of a short key = %q, want all of it", got)
+	}
+}
+
+func TestMatchAPIKey(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	// Keys sharing a prefix are told apart by their hash
+	secret := "abcdefgh-secret"
+	other := "abcdefgh-other"
+
+	tests := []struct {
+		name       string
+		candidates []APIKey
+		given      string
+		wantID     uint // 0 for no match
+	}{
+		{"match", []APIKey{{ID: 1, Hash: hashAPIKey(other)}, {ID: 2, Hash: hashAPIKey(secret)}}, secret, 2},
+		{"wrong key with the same prefix", []APIKey{{ID: 1, Hash: hashAPIKey(other)}}, secret, 0},
+		{"no candidates", nil, secret, 0},
+		{"revoked", []APIKey{{ID: 1, Hash: hashAPIKey(secret), RevokedAt: &past}}, secret, 0},
+		{"expired", []APIKey{{ID: 1, Hash: hashAPIKey(secret), ExpiresAt: &past}}, secret, 0},
+		{"expiring now", []APIKey{{ID: 1, Hash: hashAPIKey(secret), ExpiresAt: &now}}, secret, 0},
+		{"not yet expired", []APIKey{{ID: 1, Hash: hashAPIKey(secret), ExpiresAt: &future}}, secret, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchAPIKey(tt.candidates, tt.given, now)
+			switch {
+			case tt.wantID == 0 && got != nil:
+				t.Errorf("matched key %d, want none", got.ID)
+			case tt.wantID != 0 && (got == nil || got.ID != tt.wantID):
+				t.Errorf("matched %+v, want key %d", got, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestMethodScope(t *testing.T) {
+	tests := map[string]string{
+		http.MethodGet:     scopeRead,
+		http.MethodHead:    scopeRead,
+		http.MethodOptions: scopeRead,
+		http.MethodPost:    scopeWrite,
+		http.MethodPut:     scopeWrite,
+		http.MethodPatch:   scopeWrite,
+		http.MethodDelete:  scopeWrite,
+	}
+	for method, want := range tests {
+		if got := methodScope(method); got != want {
+			t.Errorf("methodScope(%s) = %s, want %s", method, got, want)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes string
+		scope  string
+		want   bool
+	}{
+		{"read,write", scopeRead, true},
+		{"read,write", scopeWrite, true},
+		{"read,write", scopeAdmin, false},
+		{"read", scopeWrite, false},
+		{"read,write,admin", scopeAdmin, true},
+		// admin doesn't imply the others
+		{"admin", scopeRead, false},
+		{"", scopeRead, false},
+	}
+	for _, tt := range tests {
+		key := APIKey{Scopes: tt.scopes}
+		if got := key.hasScope(tt.scope); got != tt.want {
+			t.Errorf("key with %q has %s = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyPayloadParse(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	days := func(n int) *int { return &n }
+
+	tests := []struct {
+		name        string
+		payload     apiKeyPayload
+		wantScopes  []string
+		wantExpires *time.Time
+		wantErr     bool
+	}{
+		{name: "defaults", wantScopes: []string{scopeRead, scopeWrite}},
+		{name: "duplicate scopes", payload: apiKeyPayload{Scopes: []string{"read", "read"}}, wantScopes: []string{scopeRead}},
+		{name: "empty scopes", payload: apiKeyPayload{Scopes: []string{}}, wantErr: true},
+		{name: "unknown scope", payload: apiKeyPayload{Scopes: []string{"root"}}, wantErr: true},
+		{name: "expires at", payload: apiKeyPayload{ExpiresAt: "2026-11-01T00:00:00Z"},
+			wantScopes: defaultScopes, wantExpires: ptr(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC))},
+		{name: "expires in days", payload: apiKeyPayload{ExpiresInDays: days(30)},
+			wantScopes: defaultScopes, wantExpires: ptr(now.AddDate(0, 0, 30))},
+		{name: "expires in the past", payload: apiKeyPayload{ExpiresAt: "2026-10-01T00:00:00Z"}, wantErr: true},
+		{name: "invalid expiry", payload: apiKeyPayload{ExpiresAt: "2026-11-01"}, wantErr: true},
+		{name: "zero days", payload: apiKeyPayload{ExpiresInDays: days(0)}, wantErr: true},
+		{name: "both expiries", payload: apiKeyPayload{ExpiresAt: "2026-11-01T00:00:00Z", ExpiresInDays: days(1)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scopes, expires, msg := tt.payload.parse(now)
+			if (msg != "") != tt.wantErr {
+				t.Fatalf("message = %q, want error %v", msg, tt.wantErr)
+			}
+			if !slices.Equal(scopes, tt.wantScopes) {
+				t.Errorf("scopes = %q, want %q", scopes, tt.wantScopes)
+			}
+			if !reflect.DeepEqual(expires, tt.wantExpires) {
+				t.Errorf("expires = %v, want %v", expires, tt.wantExpires)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRequireAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := validConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+
+	r := gin.New()
+	r.GET("/users", requireAdmin(dryRunDB(t)), func(c *gin.Context) {
+		if !c.GetBool("admin") {
+			t.Error("admin wasn't set on the context")
+		}
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"deployment key", cfg.Auth.APIKey, http.StatusOK},
+		{"unknown key", "not-the-key", http.StatusUnauthorized},
+		{"deployment key prefix", cfg.Auth.APIKey[:3], http.StatusUnauthorized},
+		{"no key", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set("X-API-Key", tt.key)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRefusesDefaultSecret(t *testing.T) {
+	clearConfigEnv(t, reflect.TypeOf(Config{}))
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("DATABASE_URL", "host=localhost dbname=gym")
+
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "auth.api_key:") {
+		t.Errorf("loading without API_KEY = %v, want an auth.api_key error", err)
+	}
+
+	t.Setenv("API_KEY", defaultAdminKey)
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "auth.api_key:") {
+		t.Errorf("loading with the default API_KEY = %v, want an auth.api_key error", err)
+	}
+
+	t.Setenv("APP_ENV", "development")
+	if _, err := loadConfig(); err != nil {
+		t.Errorf("loading the default API_KEY in development = %v, want no error", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// defaultAdminKey is the API_KEY fallback, which is only accepted in
+// development mode.
+const defaultAdminKey = "default-secret"
+
+// adminAPIKey returns the deployment-wide key used for administrative
+// endpoints such as creating users.
+func adminAPIKey() string {
+	return currentConfig().Auth.APIKey
+}
+
+// generateAPIKey returns a random hex-encoded key.
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// requireAdmin only lets requests through that present the deployment's
+// API_KEY or an API key with the admin scope.
+func requireAdmin(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := c.GetHeader("X-API-Key")
+		if given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(adminAPIKey())) == 1 {
+			c.Set("admin", true)
+			c.Next()
+			return
+		}
+
+		key, ok := authenticateKey(c, db.WithContext(c.Request.Context()), given, scopeAdmin)
+		if !ok {
+			return
+		}
+		c.Set("admin", true)
+		c.Set("api_key", key)
+		c.Next()
+	}
+}
+
+// authenticateKey verifies an API key and its scope, aborting the request
+// if it isn't valid.
+func authenticateKey(c *gin.Context, db *gorm.DB, given, scope string) (*APIKey, bool) {
+	key, err := findAPIKey(db, given, time.Now())
+	if err != nil {
+		internalError(c, err)
+		return nil, false
+	}
+	if key == nil {
+		unauthorized(c, "unauthorized")
+		return nil, false
+	}
+	if !key.hasScope(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+		return nil, false
+	}
+
+	if err := touchAPIKey(db, key, time.Now()); err != nil {
+		internalError(c, err)
+		return nil, false
+	}
+	return key, true
+}
+
+// loadUser stores the user with the given ID on the context for handlers
+// to scope their queries.
+func loadUser(c *gin.Context, db *gorm.DB, userID uint) bool {
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			unauthorized(c, "unauthorized")
+			return false
+		}
+		internalError(c, err)
+		return false
+	}
+
+	c.Set("user", &user)
+	return true
+}
+
+// methodScope is the scope a request needs: read for safe methods and
+// write for everything else.
+func methodScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead
+	}
+	return scopeWrite
+}
+
+// authenticateBearer verifies an OIDC bearer token and stores the user
+// linked to its subject on the context. Tokens can read and write but not
+// administer.
+func authenticateBearer(c *gin.Context, db *gorm.DB, token string) bool {
+	if bearerVerifier == nil {
+		unauthorized(c, "bearer tokens are not enabled")
+		return false
+	}
+
+	subject, err := bearerVerifier.verify(c.Request.Context(), token)
+	if err != nil {
+		// The reason only goes to the log, not to the client
+		_ = c.Error(err)
+		unauthorized(c, "invalid token")
+		return false
+	}
+
+	var user User
+	if err := db.Where("oidc_subject = ?", subject).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			unauthorized(c, "no user is linked to this token's subject")
+			return false
+		}
+		internalError(c, err)
+		return false
+	}
+
+	c.Set("user", &user)
+	return true
+}
+
+// requireUser resolves the caller from an Authorization: Bearer token or
+// the X-API-Key header and stores the matching user on the context for
+// handlers to scope their queries.
+func requireUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
+		if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			if authenticateBearer(c, db, strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))) {
+				c.Next()
+			}
+			return
+		}
+
+		key, ok := authenticateKey(c, db, c.GetHeader("X-API-Key"), methodScope(c.Request.Method))
+		if !ok {
+			return
+		}
+		c.Set("api_key", key)
+		if !loadUser(c, db, key.UserID) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// urlToken is a kind of token that goes in URLs, for apps and pages that
+// can't send headers. Each kind only unlocks its own endpoints.
+type urlToken struct {
+	name string // as shown to clients
+	// column prefixes the <column>_prefix and <column>_hash columns
+	column string
+	hash   func(*User) *string
+}
+
+var (
+	// feedToken unlocks the calendar and the heatmap
+	feedToken = urlToken{"feed token", "feed_token", func(u *User) *string { return u.FeedTokenHash }}
+	// badgeToken unlocks the badges, which are meant to be public
+	badgeToken = urlToken{"badge token", "badge_token", func(u *User) *string { return u.BadgeTokenHash }}
+)
+
+// requireURLToken resolves the caller from the ?token= query parameter,
+// which must be a token of the given kind. Without a token it falls back
+// to the X-API-Key header.
+func requireURLToken(db *gorm.DB, kind urlToken) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
+		token, ok := c.GetQuery("token")
+		if !ok {
+			requireUser(db)(c)
+			return
+		}
+
+		user, err := findTokenUser(db, kind, token)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if user == nil {
+			unauthorized(c, "unauthorized")
+			return
+		}
+
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// findTokenUser returns the user whose token of the given kind is token,
+// or nil if there is none. Like API keys, candidates are found by prefix
+// and compared by hash in constant time.
+func findTokenUser(db *gorm.DB, kind urlToken, token string) (*User, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	var candidates []User
+	if err := db.Where(kind.column+"_prefix = ?", apiKeyPrefix(token)).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	hash := []byte(hashAPIKey(token))
+	var match *User
+	for i := range candidates {
+		if stored := kind.hash(&candidates[i]); stored != nil && subtle.ConstantTimeCompare(hash, []byte(*stored)) == 1 {
+			match = &candidates[i]
+		}
+	}
+	return match, nil
+}
+
+// unauthorized rejects a request whose credentials weren't accepted. Each
+// rejection takes from the client's authentication failures, and once those
+// run out it gets a 429 instead.
+func unauthorized(c *gin.Context, msg string) {
+	if limit, ok := c.Get("auth_failures"); ok && !limit.(func(*gin.Context) bool)(c) {
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+}
+
+// currentUser returns the user authenticated by requireUser.
+func currentUser(c *gin.Context) *User {
+	return c.MustGet("user").(*User)
+}
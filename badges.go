@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// badgeMaxAge is short since badges change with every visit.
+const badgeMaxAge = 300
+
+// maxBadgeLabel caps custom labels so badges stay badge-sized.
+const maxBadgeLabel = 40
+
+// textWidth estimates the width of s in 11px Verdana, which badges are set
+// in. It only needs to be close enough to pad the text evenly.
+func textWidth(s string) int {
+	width := 0.0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("iIl.,:;|!'", r):
+			width += 3.7
+		case strings.ContainsRune("fjtr()[] /", r):
+			width += 4.9
+		case strings.ContainsRune("mwMW%", r):
+			width += 10.5
+		case r >= 'A' && r <= 'Z':
+			width += 7.8
+		case r > utf8.RuneSelf:
+			width += 11 // emoji and the like
+		default:
+			width += 6.8
+		}
+	}
+	return int(width + 0.5)
+}
+
+// renderBadge draws a shields.io style badge with label on the left and
+// value on the right.
+func renderBadge(label, value, labelColor, color string, square bool) string {
+	labelWidth := textWidth(label) + 10
+	valueWidth := textWidth(value) + 10
+	width := labelWidth + valueWidth
+	label, value = html.EscapeString(label), html.EscapeString(value)
+
+	radius := 3
+	if square {
+		radius = 0
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, width, label, value)
+	fmt.Fprintf(&b, `<title>%s: %s</title>`, label, value)
+	if !square {
+		b.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	}
+	fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="20" rx="%d" fill="#fff"/></clipPath>`, width, radius)
+	fmt.Fprintf(&b, `<g clip-path="url(#r)"><rect width="%d" height="20" fill="%s"/><rect x="%d" width="%d" height="20" fill="%s"/>`, labelWidth, labelColor, labelWidth, valueWidth, color)
+	if !square {
+		fmt.Fprintf(&b, `<rect width="%d" height="20" fill="url(#s)"/>`, width)
+	}
+	b.WriteString(`</g>`)
+	b.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	for _, t := range []struct {
+		x    int
+		text string
+	}{{labelWidth / 2, label}, {labelWidth + valueWidth/2, value}} {
+		fmt.Fprintf(&b, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>`, t.x, t.text, t.x, t.text)
+	}
+	b.WriteString(`</g></svg>`)
+	return b.String()
+}
+
+// writeBadge applies the label, color and style query parameters to a badge
+// and sends it.
+func writeBadge(c *gin.Context, label, value, color string) {
+	if custom := strings.TrimSpace(c.Query("label")); custom != "" {
+		if utf8.RuneCountInString(custom) > maxBadgeLabel {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("label must be at most %d characters", maxBadgeLabel)})
+			return
+		}
+		label = custom
+	}
+
+	color, ok := colorParam(c, "color", color)
+	if !ok {
+		return
+	}
+	labelColor, ok := colorParam(c, "labelColor", "#555")
+	if !ok {
+		return
+	}
+
+	style := c.DefaultQuery("style", "flat")
+	if style != "flat" && style != "flat-square" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "style must be flat or flat-square"})
+		return
+	}
+
+	writeSVG(c, renderBadge(label, value, labelColor, color, style == "flat-square"), badgeMaxAge)
+}
+
+func getStreakBadge(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		streak, err := activeStreak(db, user)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		// Same tiers as GET /visits/streak, a broken streak shows as 0
+		color := namedColors["lightgrey"]
+		switch {
+		case streak >= 7:
+			color = namedColors["brightgreen"]
+		case streak >= 4:
+			color = namedColors["orange"]
+		case streak >= 1:
+			color = namedColors["green"]
+		}
+
+		value := fmt.Sprintf("%d days", streak)
+		if streak == 1 {
+			value = "1 day"
+		}
+		writeBadge(c, "streak", value, color)
+	}
+}
+
+func getProgressBadge(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, count, percent, err := goalProgress(db, user)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		// Same thresholds as GET /visits/progress/message
+		var color string
+		switch {
+		case percent >= 100:
+			color = namedColors["brightgreen"]
+		case percent >= 80:
+			color = namedColors["green"]
+		case percent >= 50:
+			color = namedColors["yellowgreen"]
+		case percent >= 20:
+			color = namedColors["yellow"]
+		default:
+			color = namedColors["orange"]
+		}
+
+		label := "gym visits"
+		if goal.Name != "" {
+			label = goal.Name
+		}
+		writeBadge(c, label, fmt.Sprintf("%d/%d (%d%%)", count, goal.Value, percent), color)
+	}
+}
+
+func getMilestoneBadge(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		totalVisits, milestones, next, err := milestoneStatus(db, user)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		var value, color string
+		switch {
+		case len(milestones) == 0:
+			value, color = "none set", namedColors["lightgrey"]
+		case next == nil:
+			value, color = fmt.Sprintf("all %d reached", len(milestones)), namedColors["brightgreen"]
+		default:
+			value, color = fmt.Sprintf("%d/%d %s", totalVisits, next.Target, next.Name), namedColors["blue"]
+		}
+		writeBadge(c, "next milestone", value, color)
+	}
+}
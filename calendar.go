@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// icsEscape escapes a text value as RFC 5545 requires.
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// writeICSLine writes a content line, folding it at 75 octets without
+// splitting a UTF-8 character.
+func writeICSLine(w io.Writer, line string) error {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		if _, err := io.WriteString(w, line[:cut]+"\r\n "); err != nil {
+			return err
+		}
+		line = line[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	_, err := io.WriteString(w, line+"\r\n")
+	return err
+}
+
+// icsEvent is an all-day calendar event.
+type icsEvent struct {
+	UID         string
+	Day         time.Time
+	Summary     string
+	Description string
+}
+
+func (e icsEvent) lines(stamp time.Time) []string {
+	lines := []string{
+		"BEGIN:VEVENT",
+		"UID:" + e.UID,
+		"DTSTAMP:" + stamp.UTC().Format("20060102T150405Z"),
+		"DTSTART;VALUE=DATE:" + e.Day.Format("20060102"),
+		"DTEND;VALUE=DATE:" + e.Day.AddDate(0, 0, 1).Format("20060102"),
+		"SUMMARY:" + icsEscape(e.Summary),
+	}
+	if e.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+icsEscape(e.Description))
+	}
+	// All-day gym events shouldn't show as busy next to meetings
+	return append(lines, "TRANSP:TRANSPARENT", "END:VEVENT")
+}
+
+// visitEvent describes a visited day, titled with its workouts.
+func visitEvent(entry Entry, loc *time.Location) icsEvent {
+	var names, details []string
+	for _, s := range entry.Sessions {
+		name := "Workout"
+		if s.Workout != nil {
+			name = s.Workout.Name
+			names = append(names, name)
+		}
+
+		var parts []string
+		if s.StartTime != nil {
+			parts = append(parts, "at "+s.StartTime.In(loc).Format("15:04"))
+		}
+		if s.DurationMinutes != nil {
+			parts = append(parts, fmt.Sprintf("%d min", *s.DurationMinutes))
+		}
+		if s.DistanceMeters != nil {
+			parts = append(parts, fmt.Sprintf("%.1f km", *s.DistanceMeters/1000))
+		}
+		if len(parts) > 0 {
+			details = append(details, name+" "+strings.Join(parts, ", "))
+		}
+	}
+
+	summary := "Gym"
+	if len(names) > 0 {
+		summary = strings.Join(names, ", ")
+	}
+
+	return icsEvent{
+		UID:         fmt.Sprintf("entry-%d@gym-api", entry.ID),
+		Day:         entry.Date.UTC(),
+		Summary:     summary,
+		Description: strings.Join(details, "\n"),
+	}
+}
+
+// milestoneEvents returns an event on the day each milestone was reached,
+// i.e. the day of the visit that brought its goal's count to the target.
+func milestoneEvents(db *gorm.DB, userID uint) ([]icsEvent, error) {
+	var goals []Goal
+	if err := db.Preload("Milestones", func(db *gorm.DB) *gorm.DB {
+		return db.Order("target ASC")
+	}).Where("user_id = ?", userID).Find(&goals).Error; err != nil {
+		return nil, err
+	}
+
+	var events []icsEvent
+	for _, goal := range goals {
+		if len(goal.Milestones) == 0 {
+			continue
+		}
+
+		var dates []time.Time
+		if err := goalVisits(db, goal).Order("date ASC").Pluck("date", &dates).Error; err != nil {
+			return nil, err
+		}
+
+		for _, m := range goal.Milestones {
+			if m.Target < 1 || m.Target > len(dates) {
+				continue
+			}
+			events = append(events, icsEvent{
+				UID:         fmt.Sprintf("milestone-%d@gym-api", m.ID),
+				Day:         dates[m.Target-1].UTC(),
+				Summary:     fmt.Sprintf("🏆 %s (%d visits)", m.Name, m.Target),
+				Description: fmt.Sprintf("Reached milestone %q with visit number %d.", m.Name, m.Target),
+			})
+		}
+	}
+	return events, nil
+}
+
+func getCalendar(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+		loc := userLocation(user)
+
+		var entries []Entry
+		if err := preloadSessions(db).Where("user_id = ? AND visited = ?", user.ID, true).Order("date ASC").Find(&entries).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		milestones, err := milestoneEvents(db, user.ID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		lines := []string{
+			"BEGIN:VCALENDAR",
+			"VERSION:2.0",
+			"PRODID:-//gym-api//Gym visits//EN",
+			"CALSCALE:GREGORIAN",
+			"METHOD:PUBLISH",
+			"X-WR-CALNAME:" + icsEscape("Gym visits"),
+			"X-WR-TIMEZONE:" + loc.String(),
+			"REFRESH-INTERVAL;VALUE=DURATION:PT1H",
+			"X-PUBLISHED-TTL:PT1H",
+		}
+		now := time.Now()
+		for _, entry := range entries {
+			lines = append(lines, visitEvent(entry, loc).lines(now)...)
+		}
+		for _, event := range milestones {
+			lines = append(lines, event.lines(now)...)
+		}
+		lines = append(lines, "END:VCALENDAR")
+
+		c.Header("Content-Type", "text/calendar; charset=utf-8")
+		c.Header("Content-Disposition", `inline; filename="gym.ics"`)
+		c.Status(http.StatusOK)
+		for _, line := range lines {
+			if err := writeICSLine(c.Writer, line); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.yaml.in/yaml/v3"
+)
+
+// Config is the service configuration. It is read from the YAML file at
+// CONFIG_FILE, if set, and every setting can be overridden with the
+// environment variable in its env tag. The server, database, oidc and
+// environment settings and the rate limit store are structural and only
+// change on restart, everything else is reloaded on SIGHUP.
+type Config struct {
+	Environment string `yaml:"environment" env:"APP_ENV"`
+	LogLevel    string `yaml:"log_level" env:"LOG_LEVEL"`
+	// Timezone day boundaries are computed in for users without their own
+	Timezone string `yaml:"timezone" env:"TIMEZONE"`
+
+	Server     ServerConfig     `yaml:"server"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Auth       AuthConfig       `yaml:"auth"`
+	OIDC       OIDCConfig       `yaml:"oidc"`
+	AI         AIConfig         `yaml:"ai"`
+	CORS       CORSConfig       `yaml:"cors"`
+	Goals      GoalsConfig      `yaml:"goals"`
+	RateLimits RateLimitsConfig `yaml:"rate_limits"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+
+	// Derived from the settings above by validate
+	location *time.Location
+	logLevel slog.Level
+	limits   rateLimits
+	cors     gin.HandlerFunc
+}
+
+type ServerConfig struct {
+	Port              int           `yaml:"port" env:"PORT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	// TrustedProxies may set X-Forwarded-For, none when empty
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+type DatabaseConfig struct {
+	URL             string        `yaml:"url" env:"DATABASE_URL"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+}
+
+type AuthConfig struct {
+	// APIKey is the admin key, also used by the default user
+	APIKey string `yaml:"api_key" env:"API_KEY"`
+}
+
+type OIDCConfig struct {
+	Issuer   string `yaml:"issuer" env:"OIDC_ISSUER"`
+	Audience string `yaml:"audience" env:"OIDC_AUDIENCE"`
+	JWKSURL  string `yaml:"jwks_url" env:"OIDC_JWKS_URL"`
+	JWKSFile string `yaml:"jwks_file" env:"OIDC_JWKS_FILE"`
+}
+
+type AIConfig struct {
+	URL     string        `yaml:"url" env:"OLLAMA_URL"`
+	Model   string        `yaml:"model" env:"OLLAMA_MODEL"`
+	Timeout time.Duration `yaml:"timeout" env:"OLLAMA_TIMEOUT"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods   []string `yaml:"allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	AllowedHeaders   []string `yaml:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	AllowCredentials bool     `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+}
+
+type GoalsConfig struct {
+	// Visits is the goal used when a user has no active goal
+	Visits int `yaml:"visits" env:"GOAL_VISITS"`
+	// Weekly applies to weeks before a user set a weekly goal
+	Weekly int `yaml:"weekly" env:"GOAL_WEEKLY"`
+}
+
+type RateLimitsConfig struct {
+	Store        string `yaml:"store" env:"RATE_LIMIT_STORE"`
+	IP           string `yaml:"ip" env:"RATE_LIMIT_IP"`
+	Writes       string `yaml:"writes" env:"RATE_LIMIT_WRITES"`
+	AuthFailures string `yaml:"auth_failures" env:"RATE_LIMIT_AUTH_FAILURES"`
+	AI           string `yaml:"ai" env:"RATE_LIMIT_AI"`
+}
+
+type MetricsConfig struct {
+	// Token must be sent as a bearer token to scrape /metrics, if set. The
+	// training gauges are only served with it.
+	Token string `yaml:"token" env:"METRICS_TOKEN"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		LogLevel: "info",
+		Timezone: "UTC",
+		Server: ServerConfig{
+			Port:              8080,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      5 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+		},
+		Database: DatabaseConfig{
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		Auth: AuthConfig{APIKey: defaultAdminKey},
+		AI: AIConfig{
+			URL:     "http://localhost:11434",
+			Model:   "deepseek-r1",
+			Timeout: 4 * time.Minute,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   []string{"http://localhost:*", "https://localhost:*"},
+			AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Origin", "Content-Type", "X-API-Key", "Authorization"},
+			AllowCredentials: true,
+		},
+		Goals: GoalsConfig{Visits: 100, Weekly: 5},
+		RateLimits: RateLimitsConfig{
+			Store:        "memory",
+			IP:           "600/m",
+			Writes:       "60/m",
+			AuthFailures: "20/h",
+			AI:           "10/h",
+		},
+	}
+}
+
+// activeConfig is swapped as a whole on reload, so a request sees either
+// the old or the new settings but never a mix.
+var activeConfig atomic.Pointer[Config]
+
+// currentConfig returns the configuration in effect.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// setConfig puts cfg into effect.
+func setConfig(cfg *Config) {
+	activeConfig.Store(cfg)
+	logLevel.Set(cfg.logLevel)
+}
+
+// loadConfig reads the configuration and validates it.
+func loadConfig() (*Config, error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfig reads the defaults, the file at CONFIG_FILE and the
+// environment, in that order, without validating the result.
+func readConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		// A misspelt setting would otherwise be ignored silently
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides settings with the environment variables named in
+// their env tags. Empty variables count as unset.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		raw := os.Getenv(name)
+		if name == "" || raw == "" {
+			continue
+		}
+		if err := setFromString(value, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setFromString(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, use e.g. 30s or 5m", s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q, use true or false", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(splitList(s)))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// validate checks every setting, reporting all problems at once, and
+// derives the parsed forms the rest of the service uses.
+func (c *Config) validate() error {
+	var errs []error
+	invalid := func(setting, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", setting, fmt.Sprintf(format, args...)))
+	}
+
+	if err := c.logLevel.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		invalid("log_level", "%q isn't debug, info, warn or error", c.LogLevel)
+	}
+	if loc, err := time.LoadLocation(c.Timezone); err != nil {
+		invalid("timezone", "%q isn't an IANA timezone like Pacific/Auckland", c.Timezone)
+	} else {
+		c.location = loc
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		invalid("server.port", "%d isn't a port number", c.Server.Port)
+	}
+	for name, d := range map[string]time.Duration{
+		"server.read_header_timeout":  c.Server.ReadHeaderTimeout,
+		"server.read_timeout":         c.Server.ReadTimeout,
+		"server.write_timeout":        c.Server.WriteTimeout,
+		"server.idle_timeout":         c.Server.IdleTimeout,
+		"database.conn_max_lifetime":  c.Database.ConnMaxLifetime,
+		"database.conn_max_idle_time": c.Database.ConnMaxIdleTime,
+	} {
+		if d < 0 {
+			invalid(name, "must not be negative, use 0 for none")
+		}
+	}
+
+	if c.Database.URL == "" {
+		invalid("database.url", "not set, set it or DATABASE_URL")
+	}
+	if c.Database.MaxOpenConns < 0 {
+		invalid("database.max_open_conns", "must not be negative, use 0 for unlimited")
+	}
+	if c.Database.MaxIdleConns < 0 {
+		invalid("database.max_idle_conns", "must not be negative")
+	} else if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		invalid("database.max_idle_conns", "can't be more than database.max_open_conns")
+	}
+
+	// A deployment can't accidentally run with a publicly known secret
+	switch {
+	case c.Auth.APIKey == "":
+		invalid("auth.api_key", "must not be empty")
+	case c.Auth.APIKey == defaultAdminKey && c.Environment != "development":
+		invalid("auth.api_key", "unset or the default secret, set it or API_KEY, or run with APP_ENV=development")
+	}
+	if c.OIDC.Issuer != "" && c.OIDC.Audience == "" {
+		invalid("oidc.audience", "must be set along with oidc.issuer")
+	}
+
+	if u, err := url.Parse(c.AI.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("ai.url", "%q isn't an http(s) URL", c.AI.URL)
+	}
+	if c.AI.Model == "" {
+		invalid("ai.model", "must not be empty")
+	}
+	if c.AI.Timeout <= 0 {
+		invalid("ai.timeout", "must be positive")
+	} else if c.Server.WriteTimeout > 0 && c.AI.Timeout >= c.Server.WriteTimeout {
+		invalid("ai.timeout", "must be shorter than server.write_timeout (%s), or the response can't be sent", c.Server.WriteTimeout)
+	}
+
+	if handler, err := corsHandler(c.CORS); err != nil {
+		invalid("cors", "%v", err)
+	} else {
+		c.cors = handler
+	}
+
+	if c.Goals.Visits < 1 {
+		invalid("goals.visits", "must be at least 1")
+	}
+	if c.Goals.Weekly < 1 || c.Goals.Weekly > 7 {
+		invalid("goals.weekly", "must be between 1 and 7")
+	}
+
+	if c.RateLimits.Store != "memory" && c.RateLimits.Store != "postgres" {
+		invalid("rate_limits.store", "%q isn't memory or postgres", c.RateLimits.Store)
+	}
+	for _, setting := range []struct {
+		name  string
+		value string
+		limit *rateLimit
+	}{
+		{"rate_limits.ip", c.RateLimits.IP, &c.limits.ip},
+		{"rate_limits.writes", c.RateLimits.Writes, &c.limits.writes},
+		{"rate_limits.auth_failures", c.RateLimits.AuthFailures, &c.limits.authFailures},
+		{"rate_limits.ai", c.RateLimits.AI, &c.limits.ai},
+	} {
+		limit, err := parseRateLimit(setting.value)
+		if err != nil {
+			invalid(setting.name, "%v", err)
+			continue
+		}
+		*setting.limit = limit
+	}
+
+	return errors.Join(errs...)
+}
+
+// keepStructural copies the settings that need a restart from prev, and
+// returns the names of those that differ.
+func (c *Config) keepStructural(prev *Config) []string {
+	var changed []string
+	if c.Environment != prev.Environment {
+		changed = append(changed, "environment")
+	}
+	if !reflect.DeepEqual(c.Server, prev.Server) {
+		changed = append(changed, "server")
+	}
+	if c.Database != prev.Database {
+		changed = append(changed, "database")
+	}
+	if c.OIDC != prev.OIDC {
+		changed = append(changed, "oidc")
+	}
+	if c.RateLimits.Store != prev.RateLimits.Store {
+		changed = append(changed, "rate_limits.store")
+	}
+
+	c.Environment = prev.Environment
+	c.Server = prev.Server
+	c.Database = prev.Database
+	c.OIDC = prev.OIDC
+	c.RateLimits.Store = prev.RateLimits.Store
+	return changed
+}
+
+// reloadConfig loads the configuration again and puts it into effect,
+// keeping the current one if it isn't valid. The structural settings in
+// effect are put back before validating, so the new settings are checked
+// against the ones they will actually run with. It reports whether the
+// config was reloaded.
+func reloadConfig() bool {
+	next, err := readConfig()
+	if err == nil {
+		if changed := next.keepStructural(currentConfig()); len(changed) > 0 {
+			slog.Warn("config changes need a restart to take effect", "settings", changed)
+		}
+		err = next.validate()
+	}
+	if err != nil {
+		slog.Error("config reload failed, keeping the current config", "error", err)
+		return false
+	}
+	setConfig(next)
+	slog.Info("config reloaded")
+	return true
+}
+
+// reloadOnSIGHUP reloads the configuration whenever the process receives
+// SIGHUP, calling reloaded after each successful reload.
+func reloadOnSIGHUP(reloaded func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if reloadConfig() {
+			reloaded()
+		}
+	}
+}
+
+// corsMiddleware applies the CORS policy in effect, so origins can be
+// changed with a reload.
+func corsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currentConfig().cors(c)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns the defaults with the settings that have to be set.
+func validConfig() *Config {
+	cfg := defaultConfig()
+	cfg.Database.URL = "host=localhost dbname=gym"
+	cfg.Auth.APIKey = "s3cret"
+	return cfg
+}
+
+// clearConfigEnv unsets the environment variables the settings of typ are
+// read from, so the environment running the tests can't change them.
+func clearConfigEnv(t *testing.T, typ reflect.Type) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Type.Kind() == reflect.Struct && field.IsExported() {
+			clearConfigEnv(t, field.Type)
+		} else if name := field.Tag.Get("env"); name != "" {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		errs   []string // settings named in the error, none if valid
+	}{
+		{"defaults", func(*Config) {}, nil},
+		{"default secret in development", func(c *Config) {
+			c.Environment = "development"
+			c.Auth.APIKey = defaultAdminKey
+		}, nil},
+		{"default secret", func(c *Config) { c.Auth.APIKey = defaultAdminKey }, []string{"auth.api_key"}},
+		{"empty secret in development", func(c *Config) {
+			c.Environment = "development"
+			c.Auth.APIKey = ""
+		}, []string{"auth.api_key"}},
+		{"log level", func(c *Config) { c.LogLevel = "verbose" }, []string{"log_level"}},
+		{"timezone", func(c *Config) { c.Timezone = "Mars/Olympus" }, []string{"timezone"}},
+		{"port", func(c *Config) { c.Server.Port = 70000 }, []string{"server.port"}},
+		{"negative timeout", func(c *Config) { c.Server.IdleTimeout = -time.Second }, []string{"server.idle_timeout"}},
+		{"no database", func(c *Config) { c.Database.URL = "" }, []string{"database.url"}},
+		{"more idle than open conns", func(c *Config) { c.Database.MaxIdleConns = 30 }, []string{"database.max_idle_conns"}},
+		{"idle conns with unlimited open", func(c *Config) {
+			c.Database.MaxOpenConns = 0
+			c.Database.MaxIdleConns = 30
+		}, nil},
+		{"issuer without audience", func(c *Config) { c.OIDC.Issuer = "https://id.example.com" }, []string{"oidc.audience"}},
+		{"ai url", func(c *Config) { c.AI.URL = "localhost:11434" }, []string{"ai.url"}},
+		{"ai timeout past write timeout", func(c *Config) { c.AI.Timeout = 5 * time.Minute }, []string{"ai.timeout"}},
+		{"ai timeout without write timeout", func(c *Config) {
+			c.Server.WriteTimeout = 0
+			c.AI.Timeout = time.Hour
+		}, nil},
+		{"cors", func(c *Config) { c.CORS.AllowedOrigins = []string{"*"} }, []string{"cors"}},
+		{"weekly goal", func(c *Config) { c.Goals.Weekly = 8 }, []string{"goals.weekly"}},
+		{"rate limit store", func(c *Config) { c.RateLimits.Store = "redis" }, []string{"rate_limits.store"}},
+		{"rate limit", func(c *Config) { c.RateLimits.AI = "10" }, []string{"rate_limits.ai"}},
+		{"every problem at once", func(c *Config) {
+			c.Server.Port = 0
+			c.Goals.Visits = 0
+			c.AI.Model = ""
+		}, []string{"server.port", "goals.visits", "ai.model"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(cfg)
+			err := cfg.validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors for %v", tt.errs)
+			}
+			for _, setting := range tt.errs {
+				if !strings.Contains(err.Error(), setting+":") {
+					t.Errorf("error %q doesn't mention %s", err, setting)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigValidateDerived(t *testing.T) {
+	cfg := validConfig()
+	cfg.Timezone = "Pacific/Auckland"
+	cfg.RateLimits.Writes = "off"
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.location.String() != "Pacific/Auckland" {
+		t.Errorf("location = %s, want Pacific/Auckland", cfg.location)
+	}
+	if cfg.limits.ip != (rateLimit{Rate: 10, Burst: 600}) {
+		t.Errorf("ip limit = %+v, want 600/m", cfg.limits.ip)
+	}
+	if cfg.limits.writes.enabled() {
+		t.Error("writes limit is enabled, want off")
+	}
+	if cfg.cors == nil {
+		t.Error("cors handler wasn't built")
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	clearConfigEnv(t, reflect.TypeOf(Config{}))
+	t.Setenv("CONFIG_FILE", filepath.Join("testdata", "config.yaml"))
+	// The environment overrides the file
+	t.Setenv("PORT", "7070")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example.com, https://b.example.com")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Environment != "development" || cfg.Auth.APIKey != defaultAdminKey {
+		t.Errorf("environment = %q, api key = %q, want development with the default key", cfg.Environment, cfg.Auth.APIKey)
+	}
+	if cfg.Server.Port != 7070 {
+		t.Errorf("port = %d, want 7070 from PORT", cfg.Server.Port)
+	}
+	if cfg.Server.WriteTimeout != 10*time.Minute || cfg.Server.ReadTimeout != time.Minute {
+		t.Errorf("write timeout = %s, read timeout = %s, want 10m from the file and the default 1m", cfg.Server.WriteTimeout, cfg.Server.ReadTimeout)
+	}
+	if want := []string{"https://a.example.com", "https://b.example.com"}; !slices.Equal(cfg.CORS.AllowedOrigins, want) {
+		t.Errorf("allowed origins = %q, want %q", cfg.CORS.AllowedOrigins, want)
+	}
+	if cfg.limits.writes.enabled() {
+		t.Error("writes limit is enabled, want off")
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+	}{
+		{name: "unknown setting", yaml: "server:\n  prot: 8080\n"},
+		{name: "invalid yaml", yaml: "server: [\n"},
+		{name: "invalid duration", env: map[string]string{"OLLAMA_TIMEOUT": "4 minutes"}},
+		{name: "invalid number", env: map[string]string{"PORT": "http"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			clearConfigEnv(t, reflect.TypeOf(Config{}))
+			t.Setenv("CONFIG_FILE", path)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if _, err := readConfig(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestKeepStructural(t *testing.T) {
+	prev := validConfig()
+	next := validConfig()
+	next.Server.Port = 9090
+	next.RateLimits.Store = "postgres"
+	next.RateLimits.IP = "100/m"
+	next.LogLevel = "debug"
+
+	changed := next.keepStructural(prev)
+	if want := []string{"server", "rate_limits.store"}; !slices.Equal(changed, want) {
+		t.Errorf("changed = %q, want %q", changed, want)
+	}
+	if next.Server.Port != 8080 || next.RateLimits.Store != "memory" {
+		t.Errorf("structural settings weren't put back: port %d, store %s", next.Server.Port, next.RateLimits.Store)
+	}
+	if next.RateLimits.IP != "100/m" || next.LogLevel != "debug" {
+		t.Error("reloadable settings were put back")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// originPattern is an allowed origin: exact (https://gym.example.com), any
+// subdomain (https://*.example.com) or any port (http://localhost:*).
+type originPattern struct {
+	scheme     string
+	host       string
+	subdomains bool   // host is a parent domain, not the origin's host
+	port       string // "*" for any port or none
+}
+
+func parseOriginPattern(s string) (originPattern, error) {
+	invalid := fmt.Errorf("invalid origin %q, use e.g. https://gym.example.com, https://*.example.com or http://localhost:*", s)
+
+	scheme, host, ok := strings.Cut(s, "://")
+	if !ok || (scheme != "http" && scheme != "https") || strings.ContainsAny(host, "/?#@") {
+		return originPattern{}, invalid
+	}
+	p := originPattern{scheme: scheme}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host, p.port = h, port
+	}
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		host, p.subdomains = rest, true
+	}
+	if host == "" || strings.Contains(host, "*") {
+		return originPattern{}, invalid
+	}
+	if _, err := strconv.Atoi(p.port); p.port != "" && p.port != "*" && err != nil {
+		return originPattern{}, invalid
+	}
+	p.host = strings.ToLower(host)
+	return p, nil
+}
+
+func (p originPattern) matches(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != p.scheme || u.Path != "" || u.User != nil {
+		return false
+	}
+	if p.port != "*" && u.Port() != p.port {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if p.subdomains {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// corsConfig turns a CORS policy into the middleware's configuration.
+// An origin of "*" allows every origin.
+func corsConfig(policy CORSConfig) (cors.Config, error) {
+	config := cors.Config{
+		AllowMethods: policy.AllowedMethods,
+		AllowHeaders: policy.AllowedHeaders,
+		// Let browsers read the headers clients need for retries, bug reports
+		// and pagination
+		ExposeHeaders:    []string{"Retry-After", "X-Request-ID", "X-Trace-ID", "X-Total-Count"},
+		AllowCredentials: policy.AllowCredentials,
+	}
+
+	origins := policy.AllowedOrigins
+	if slices.Contains(origins, "*") {
+		if len(origins) > 1 {
+			return cors.Config{}, errors.New("can't combine * with other origins")
+		}
+		// Browsers refuse credentials for any origin, so don't pretend
+		if config.AllowCredentials {
+			return cors.Config{}, errors.New("allowing every origin needs allow_credentials to be false")
+		}
+		config.AllowAllOrigins = true
+		return config, config.Validate()
+	}
+
+	var patterns []originPattern
+	for _, origin := range origins {
+		p, err := parseOriginPattern(origin)
+		if err != nil {
+			return cors.Config{}, err
+		}
+		patterns = append(patterns, p)
+	}
+	config.AllowOriginFunc = func(origin string) bool {
+		for _, p := range patterns {
+			if p.matches(origin) {
+				return true
+			}
+		}
+		return false
+	}
+	return config, config.Validate()
+}
+
+// corsHandler builds the CORS middleware for a policy.
+func corsHandler(policy CORSConfig) (gin.HandlerFunc, error) {
+	config, err := corsConfig(policy)
+	if err != nil {
+		return nil, err
+	}
+	return cors.New(config), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestParseOriginPatternErrors(t *testing.T) {
+	for _, origin := range []string{
+		"gym.example.com",
+		"ftp://gym.example.com",
+		"https://gym.example.com/app",
+		"https://user@gym.example.com",
+		"https://",
+		"https://*",
+		"https://*.*.example.com",
+		"https://gym.*.com",
+		"https://gym.example.com:http",
+	} {
+		t.Run(origin, func(t *testing.T) {
+			if _, err := parseOriginPattern(origin); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestOriginPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"https://gym.example.com", "https://gym.example.com", true},
+		{"https://gym.example.com", "https://GYM.example.com", true},
+		{"https://gym.example.com", "http://gym.example.com", false},
+		{"https://gym.example.com", "https://gym.example.com:8443", false},
+		{"https://gym.example.com", "https://gym.example.com.evil.com", false},
+		{"https://gym.example.com", "https://gym.example.com/path", false},
+
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "https://app.example.com:8443", false},
+
+		{"http://localhost:*", "http://localhost", true},
+		{"http://localhost:*", "http://localhost:3000", true},
+		{"http://localhost:*", "https://localhost:3000", false},
+		{"http://localhost:*", "http://localhost.evil.com:3000", false},
+
+		{"http://localhost:3000", "http://localhost:3000", true},
+		{"http://localhost:3000", "http://localhost:3001", false},
+		{"http://localhost:3000", "http://localhost", false},
+
+		{"https://gym.example.com", "null", false},
+		{"https://gym.example.com", "https://user@gym.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.origin, func(t *testing.T) {
+			p, err := parseOriginPattern(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.matches(tt.origin); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		creds   bool
+		wantErr bool
+	}{
+		{"patterns", []string{"https://gym.example.com", "http://localhost:*"}, true, false},
+		{"any origin", []string{"*"}, false, false},
+		{"any origin with credentials", []string{"*"}, true, true},
+		{"any origin with others", []string{"*", "https://gym.example.com"}, false, true},
+		{"invalid origin", []string{"gym.example.com"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := defaultConfig().CORS
+			policy.AllowedOrigins = tt.origins
+			policy.AllowCredentials = tt.creds
+			_, err := corsConfig(policy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// userLocation returns the timezone that day boundaries are computed in for
+// user.
+func userLocation(user *User) *time.Location {
+	if user.Timezone != "" {
+		if loc, err := time.LoadLocation(user.Timezone); err == nil {
+			return loc
+		}
+	}
+	// Users who haven't set their own get the configured timezone
+	return currentConfig().location
+}
+
+// Dates of entries, goals and records are calendar days, stored as midnight
+// UTC of the day. They don't move when a user changes timezone; the
+// timezone only decides which day it is now.
+
+// parseDate interprets a YYYY-MM-DD string as a calendar day.
+func parseDate(value string) (time.Time, error) {
+	return time.Parse("2006-01-02", value)
+}
+
+// dateIn returns the calendar day t falls on in loc.
+func dateIn(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// currentDate returns the current calendar day in loc.
+func currentDate(loc *time.Location) time.Time {
+	return dateIn(time.Now(), loc)
+}
+
+// formatDate formats a stored calendar day as YYYY-MM-DD. The driver may
+// return it in another zone, so it is read in UTC.
+func formatDate(day time.Time) string {
+	return day.UTC().Format("2006-01-02")
+}
+
+// midnightIn returns the start of a calendar day in loc, for responses
+// that show dates as times.
+func midnightIn(day time.Time, loc *time.Location) time.Time {
+	y, m, d := day.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// startOfWeek returns the Monday of day's week.
+func startOfWeek(day time.Time) time.Time {
+	day = day.UTC()
+	weekday := int(day.Weekday())
+	if weekday == 0 {
+		weekday = 7 // Sunday becomes 7
+	}
+	return day.AddDate(0, 0, -(weekday - 1))
+}
+
+// daysBetween counts calendar days from a to b.
+func daysBetween(a, b time.Time) int {
+	ay, am, ad := a.UTC().Date()
+	by, bm, bd := b.UTC().Date()
+	from := time.Date(ay, am, ad, 0, 0, 0, 0, time.UTC)
+	to := time.Date(by, bm, bd, 0, 0, 0, 0, time.UTC)
+	return int(to.Sub(from).Hours() / 24)
+}
+
+// onDay scopes a query on entries to a calendar day.
+func onDay(db *gorm.DB, userID uint, day time.Time) *gorm.DB {
+	return db.Where("user_id = ? AND date = ?", userID, day)
+}
+
+// visitDays returns the distinct days of entries sorted by date
+// descending, most recent first.
+func visitDays(entries []Entry) []time.Time {
+	var days []time.Time
+	for _, e := range entries {
+		day := e.Date.UTC()
+		if len(days) > 0 && days[len(days)-1].Equal(day) {
+			continue
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+// recentStreak counts the consecutive days ending at the most recent visit.
+func recentStreak(days []time.Time) int {
+	if len(days) == 0 {
+		return 0
+	}
+	streak := 1
+	for i := 1; i < len(days); i++ {
+		expected := days[i-1].AddDate(0, 0, -1)
+		if expected.Equal(days[i]) {
+			streak++
+		} else {
+			break
+		}
+	}
+	return streak
+}
+
+// currentStreak is the recent streak if it is still alive, i.e. the last
+// visit was today or yesterday in loc, and 0 otherwise.
+func currentStreak(days []time.Time, now time.Time, loc *time.Location) int {
+	if len(days) == 0 {
+		return 0
+	}
+	if daysBetween(days[0], dateIn(now, loc)) > 1 {
+		return 0
+	}
+	return recentStreak(days)
+}
+
+// longestStreak returns the longest run of consecutive visit days.
+func longestStreak(days []time.Time) int {
+	if len(days) == 0 {
+		return 0
+	}
+	longest, streak := 1, 1
+	for i := 1; i < len(days); i++ {
+		if days[i-1].AddDate(0, 0, -1).Equal(days[i]) {
+			streak++
+		} else {
+			streak = 1
+		}
+		if streak > longest {
+			longest = streak
+		}
+	}
+	return longest
+}
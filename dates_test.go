@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDateIn(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+	newYork, _ := time.LoadLocation("America/New_York")
+
+	// 8pm on Feb 29 in New York is already Mar 1 in UTC and Auckland
+	instant := time.Date(2024, 2, 29, 20, 0, 0, 0, newYork)
+	tests := []struct {
+		loc  *time.Location
+		want string
+	}{
+		{newYork, "2024-02-29"},
+		{time.UTC, "2024-03-01"},
+		{auckland, "2024-03-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.loc.String(), func(t *testing.T) {
+			got := dateIn(instant, tt.loc)
+			if formatDate(got) != tt.want || got.Location() != time.UTC || !got.Equal(got.Truncate(24*time.Hour)) {
+				t.Errorf("dateIn = %v, want midnight UTC of %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartOfWeek(t *testing.T) {
+	tests := []struct {
+		day  string
+		want string
+	}{
+		{"2024-03-04", "2024-03-04"}, // Monday
+		{"2024-03-06", "2024-03-04"},
+		{"2024-03-10", "2024-03-04"}, // Sunday
+		{"2024-03-01", "2024-02-26"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.day, func(t *testing.T) {
+			day, err := parseDate(tt.day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatDate(startOfWeek(day)); got != tt.want {
+				t.Errorf("startOfWeek = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreaks(t *testing.T) {
+	entries := func(dates ...string) []Entry {
+		var result []Entry
+		for _, d := range dates {
+			day, err := parseDate(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, Entry{Date: day})
+		}
+		return result
+	}
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		entries []Entry
+		current int
+		longest int
+	}{
+		{"none", nil, 0, 0},
+		{"ending today", entries("2024-03-10", "2024-03-09", "2024-03-08", "2024-03-05"), 3, 3},
+		{"ending yesterday", entries("2024-03-09", "2024-03-08"), 2, 2},
+		{"broken", entries("2024-03-08", "2024-03-07", "2024-03-06"), 0, 3},
+		{"longest in the past", entries("2024-03-10", "2024-03-03", "2024-03-02", "2024-03-01", "2024-02-29"), 1, 4},
+		{"same day twice", entries("2024-03-10", "2024-03-10", "2024-03-09"), 2, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days := visitDays(tt.entries)
+			if got := currentStreak(days, now, time.UTC); got != tt.current {
+				t.Errorf("current streak = %d, want %d", got, tt.current)
+			}
+			if got := longestStreak(days); got != tt.longest {
+				t.Errorf("longest streak = %d, want %d", got, tt.longest)
+			}
+		})
+	}
+}
+
+func TestSessionStartTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+	day, _ := parseDate("2024-03-01")
+
+	tests := []struct {
+		start   string
+		want    time.Time
+		wantMsg bool
+	}{
+		{start: "18:30", want: time.Date(2024, 3, 1, 18, 30, 0, 0, newYork)},
+		{start: "2024-03-01T23:30:00-05:00", want: time.Date(2024, 3, 1, 23, 30, 0, 0, newYork)},
+		// Mar 2 in UTC but still Mar 1 in New York
+		{start: "2024-03-02T03:00:00Z", want: time.Date(2024, 3, 1, 22, 0, 0, 0, newYork)},
+		{start: "2024-03-01T03:00:00Z", wantMsg: true},
+		{start: "6pm", wantMsg: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.start, func(t *testing.T) {
+			p := sessionPayload{StartTime: tt.start}
+			var session Session
+			msg := p.apply(&session, day, newYork)
+			if (msg != "") != tt.wantMsg {
+				t.Fatalf("message = %q, want one %v", msg, tt.wantMsg)
+			}
+			if !tt.wantMsg && !session.StartTime.Equal(tt.want) {
+				t.Errorf("start time = %v, want %v", session.StartTime, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// exportVersion is bumped whenever the export schema changes incompatibly.
+const exportVersion = 1
+
+// exportCSVHeader is the column layout of CSV exports. The type column is
+// visit, set, goal or milestone and decides which other columns are filled
+// in.
+var exportCSVHeader = []string{
+	"type", "date", "workout", "start_time", "duration_minutes",
+	"goal_id", "name", "value", "start_date", "end_date",
+	"exercise", "reps", "weight", "unit", "rpe",
+}
+
+// exportRow is a session or a set of an entry. A day without sessions has
+// a session row with no session columns, so every entry has a row.
+type exportRow struct {
+	EntryID uint
+	Date    time.Time
+	Visited bool
+	IsSet   bool
+
+	SessionID sql.NullInt64
+	Workout   sql.NullString
+	StartTime sql.NullTime
+	Duration  sql.NullInt64
+
+	Exercise sql.NullString
+	Reps     sql.NullInt64
+	Weight   sql.NullFloat64
+	Unit     sql.NullString
+	RPE      sql.NullFloat64
+}
+
+type exportSession struct {
+	Workout         *string    `json:"workout"`
+	StartTime       *time.Time `json:"start_time"`
+	DurationMinutes *int64     `json:"duration_minutes"`
+}
+
+type exportSet struct {
+	Exercise string   `json:"exercise"`
+	Reps     int64    `json:"reps"`
+	Weight   float64  `json:"weight"`
+	Unit     string   `json:"unit"`
+	RPE      *float64 `json:"rpe"`
+}
+
+type exportEntry struct {
+	Date     string          `json:"date"`
+	Visited  bool            `json:"visited"`
+	Sessions []exportSession `json:"sessions"`
+	Sets     []exportSet     `json:"sets"`
+}
+
+type exportMilestone struct {
+	Name   string `json:"name"`
+	Target int    `json:"target"`
+}
+
+type exportGoal struct {
+	ID         uint              `json:"id"`
+	Name       string            `json:"name"`
+	Value      int               `json:"value"`
+	StartDate  *string           `json:"start_date"`
+	EndDate    *string           `json:"end_date"`
+	Archived   bool              `json:"archived"`
+	Milestones []exportMilestone `json:"milestones"`
+}
+
+// exportRows calls fn for every session and set of the user's entries, in
+// date order. An entry's rows are consecutive, its sessions in start order
+// and then its sets in set order.
+type exportRows func(fn func(exportRow) error) error
+
+// streamEntries reads the user's export rows from the database, without
+// loading them all into memory.
+func streamEntries(db *gorm.DB, userID uint) exportRows {
+	return func(fn func(exportRow) error) error {
+		return queryExportRows(db, userID, fn)
+	}
+}
+
+func queryExportRows(db *gorm.DB, userID uint, fn func(exportRow) error) error {
+	rows, err := db.Raw(`
+		SELECT entries.id AS entry_id, entries.date AS date, entries.visited, false AS is_set,
+			sessions.id, workouts.name, sessions.start_time, sessions.duration_minutes,
+			NULL, NULL, NULL, NULL, NULL, NULL AS set_order, sessions.id AS row_id
+		FROM entries
+		LEFT JOIN sessions ON sessions.entry_id = entries.id
+		LEFT JOIN workouts ON workouts.id = sessions.workout_id
+		WHERE entries.user_id = ?
+		UNION ALL
+		SELECT entries.id, entries.date, entries.visited, true,
+			NULL, NULL, NULL, NULL,
+			exercises.name, set_logs.reps, set_logs.weight, set_logs.unit, set_logs.rpe, set_logs.set_order, set_logs.id
+		FROM set_logs
+		JOIN entries ON entries.id = set_logs.entry_id
+		JOIN exercises ON exercises.id = set_logs.exercise_id
+		WHERE entries.user_id = ?
+		ORDER BY date, entry_id, is_set, start_time ASC NULLS LAST, set_order, row_id`, userID, userID).
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row exportRow
+		var setOrder, rowID sql.NullInt64
+		if err := rows.Scan(&row.EntryID, &row.Date, &row.Visited, &row.IsSet,
+			&row.SessionID, &row.Workout, &row.StartTime, &row.Duration,
+			&row.Exercise, &row.Reps, &row.Weight, &row.Unit, &row.RPE, &setOrder, &rowID); err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// loadExportGoals loads the user's goals with their milestones. There are
+// few enough of them to not need streaming.
+func loadExportGoals(db *gorm.DB, userID uint) ([]exportGoal, error) {
+	var goals []Goal
+	if err := db.Preload("Milestones", func(db *gorm.DB) *gorm.DB {
+		return db.Order("target ASC")
+	}).Where("user_id = ?", userID).Order("id ASC").Find(&goals).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]exportGoal, 0, len(goals))
+	for _, g := range goals {
+		goal := exportGoal{
+			ID:         g.ID,
+			Name:       g.Name,
+			Value:      g.Value,
+			Archived:   g.Archived,
+			Milestones: []exportMilestone{},
+		}
+		if g.StartDate != nil {
+			start := formatDate(*g.StartDate)
+			goal.StartDate = &start
+		}
+		if g.EndDate != nil {
+			end := formatDate(*g.EndDate)
+			goal.EndDate = &end
+		}
+		for _, m := range g.Milestones {
+			goal.Milestones = append(goal.Milestones, exportMilestone{Name: m.Name, Target: m.Target})
+		}
+		result = append(result, goal)
+	}
+	return result, nil
+}
+
+func exportCSV(w io.Writer, rows exportRows, loc *time.Location, goals []exportGoal) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(exportCSVHeader); err != nil {
+		return err
+	}
+
+	err := rows(func(row exportRow) error {
+		record := make([]string, len(exportCSVHeader))
+		record[1] = formatDate(row.Date)
+		if row.IsSet {
+			record[0] = "set"
+			record[10] = row.Exercise.String
+			record[11] = strconv.FormatInt(row.Reps.Int64, 10)
+			record[12] = strconv.FormatFloat(row.Weight.Float64, 'f', -1, 64)
+			record[13] = row.Unit.String
+			if row.RPE.Valid {
+				record[14] = strconv.FormatFloat(row.RPE.Float64, 'f', -1, 64)
+			}
+			return out.Write(record)
+		}
+
+		record[0] = "visit"
+		if row.Workout.Valid {
+			record[2] = row.Workout.String
+		}
+		if row.StartTime.Valid {
+			record[3] = row.StartTime.Time.In(loc).Format(time.RFC3339)
+		}
+		if row.Duration.Valid {
+			record[4] = strconv.FormatInt(row.Duration.Int64, 10)
+		}
+		return out.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range goals {
+		record := make([]string, len(exportCSVHeader))
+		record[0] = "goal"
+		record[5] = strconv.FormatUint(uint64(g.ID), 10)
+		record[6] = g.Name
+		record[7] = strconv.Itoa(g.Value)
+		if g.StartDate != nil {
+			record[8] = *g.StartDate
+		}
+		if g.EndDate != nil {
+			record[9] = *g.EndDate
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+
+		for _, m := range g.Milestones {
+			record := make([]string, len(exportCSVHeader))
+			record[0] = "milestone"
+			record[5] = strconv.FormatUint(uint64(g.ID), 10)
+			record[6] = m.Name
+			record[7] = strconv.Itoa(m.Target)
+			if err := out.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// groupEntries collects the rows of each entry and calls fn with the entry
+// once its rows are done, so only one entry is held at a time.
+func groupEntries(rows exportRows, loc *time.Location, fn func(*exportEntry) error) error {
+	var current *exportEntry
+	var currentID uint
+
+	err := rows(func(row exportRow) error {
+		if current == nil || row.EntryID != currentID {
+			if current != nil {
+				if err := fn(current); err != nil {
+					return err
+				}
+			}
+			current = &exportEntry{
+				Date:     formatDate(row.Date),
+				Visited:  row.Visited,
+				Sessions: []exportSession{},
+				Sets:     []exportSet{},
+			}
+			currentID = row.EntryID
+		}
+		if row.IsSet {
+			set := exportSet{
+				Exercise: row.Exercise.String,
+				Reps:     row.Reps.Int64,
+				Weight:   row.Weight.Float64,
+				Unit:     row.Unit.String,
+			}
+			if row.RPE.Valid {
+				set.RPE = &row.RPE.Float64
+			}
+			current.Sets = append(current.Sets, set)
+			return nil
+		}
+		if !row.SessionID.Valid {
+			return nil
+		}
+
+		var session exportSession
+		if row.Workout.Valid {
+			session.Workout = &row.Workout.String
+		}
+		if row.StartTime.Valid {
+			start := row.StartTime.Time.In(loc)
+			session.StartTime = &start
+		}
+		if row.Duration.Valid {
+			session.DurationMinutes = &row.Duration.Int64
+		}
+		current.Sessions = append(current.Sessions, session)
+		return nil
+	})
+	if err != nil || current == nil {
+		return err
+	}
+	return fn(current)
+}
+
+func exportJSON(w io.Writer, rows exportRows, loc *time.Location, goals []exportGoal) error {
+	if _, err := fmt.Fprintf(w, `{"version":%d,"exported_at":%q,"entries":[`, exportVersion, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	// Each entry is written out as soon as its rows are done
+	written := 0
+	err := groupEntries(rows, loc, func(entry *exportEntry) error {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			if _, err := w.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		written++
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(goals)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `],"goals":%s}`, b)
+	return err
+}
+
+func getExport(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+		loc := userLocation(user)
+
+		format := c.DefaultQuery("format", "json")
+		if format != "csv" && format != "json" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+			return
+		}
+
+		goals, err := loadExportGoals(db, user.ID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		filename := fmt.Sprintf("gym-export-%s.%s", formatDate(currentDate(loc)), format)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		if format == "csv" {
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+		}
+		c.Status(http.StatusOK)
+
+		if format == "csv" {
+			err = exportCSV(c.Writer, streamEntries(db, user.ID), loc, goals)
+		} else {
+			err = exportJSON(c.Writer, streamEntries(db, user.ID), loc, goals)
+		}
+
+		// The status is already sent, so the download just ends early
+		if err != nil {
+			requestLogger(c).Error("export failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fixedRows serves rows as if they came from the database, in order.
+func fixedRows(rows ...exportRow) exportRows {
+	return func(fn func(exportRow) error) error {
+		for _, row := range rows {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// exportFixture is two entries: a day with a timed session and two sets,
+// and a day without sessions.
+func exportFixture() exportRows {
+	day1 := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)
+	return fixedRows(
+		exportRow{EntryID: 7, Date: day1, Visited: true,
+			SessionID: sql.NullInt64{Int64: 1, Valid: true},
+			Workout:   sql.NullString{String: "Legs", Valid: true},
+			StartTime: sql.NullTime{Time: time.Date(2024, 2, 29, 17, 30, 0, 0, time.UTC), Valid: true},
+			Duration:  sql.NullInt64{Int64: 45, Valid: true}},
+		exportRow{EntryID: 7, Date: day1, Visited: true, IsSet: true,
+			Exercise: sql.NullString{String: "Squat", Valid: true},
+			Reps:     sql.NullInt64{Int64: 5, Valid: true},
+			Weight:   sql.NullFloat64{Float64: 102.5, Valid: true},
+			Unit:     sql.NullString{String: "kg", Valid: true},
+			RPE:      sql.NullFloat64{Float64: 8.5, Valid: true}},
+		exportRow{EntryID: 7, Date: day1, Visited: true, IsSet: true,
+			Exercise: sql.NullString{String: "Squat", Valid: true},
+			Reps:     sql.NullInt64{Int64: 5, Valid: true},
+			Weight:   sql.NullFloat64{Float64: 225, Valid: true},
+			Unit:     sql.NullString{String: "lb", Valid: true}},
+		exportRow{EntryID: 9, Date: day2, Visited: true},
+	)
+}
+
+func exportGoalsFixture() []exportGoal {
+	start, end := "2024-01-01", "2024-12-31"
+	return []exportGoal{{
+		ID: 3, Name: "2024", Value: 150, StartDate: &start, EndDate: &end,
+		Milestones: []exportMilestone{{Name: "Halfway", Target: 75}},
+	}}
+}
+
+func TestGroupEntries(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []exportEntry
+	err = groupEntries(exportFixture(), auckland, func(e *exportEntry) error {
+		entries = append(entries, *e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	first, second := entries[0], entries[1]
+	if first.Date != "2024-03-01" || len(first.Sessions) != 1 || len(first.Sets) != 2 {
+		t.Errorf("first entry = %+v, want 2024-03-01 with one session and two sets", first)
+	}
+	session := first.Sessions[0]
+	if session.Workout == nil || *session.Workout != "Legs" || *session.DurationMinutes != 45 {
+		t.Errorf("session = %+v, want 45 minutes of Legs", session)
+	}
+	if got := session.StartTime.Format(time.RFC3339); got != "2024-03-01T06:30:00+13:00" {
+		t.Errorf("start time = %s, want it in the user's timezone", got)
+	}
+	if first.Sets[0].RPE == nil || *first.Sets[0].RPE != 8.5 || first.Sets[1].RPE != nil || first.Sets[1].Unit != "lb" {
+		t.Errorf("sets = %+v", first.Sets)
+	}
+
+	// A day without sessions still has an entry, with empty lists
+	if second.Date != "2024-03-03" || second.Sessions == nil || len(second.Sessions) != 0 || second.Sets == nil || len(second.Sets) != 0 {
+		t.Errorf("second entry = %+v, want 2024-03-03 with no sessions or sets", second)
+	}
+
+	// No rows, no entries
+	called := false
+	if err := groupEntries(fixedRows(), time.UTC, func(*exportEntry) error { called = true; return nil }); err != nil || called {
+		t.Errorf("empty export: err %v, called %v", err, called)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := exportCSV(&buf, exportFixture(), auckland, exportGoalsFixture()); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The column layout is part of the documented schema
+	want := [][]string{
+		{"type", "date", "workout", "start_time", "duration_minutes", "goal_id", "name", "value", "start_date", "end_date", "exercise", "reps", "weight", "unit", "rpe"},
+		{"visit", "2024-03-01", "Legs", "2024-03-01T06:30:00+13:00", "45", "", "", "", "", "", "", "", "", "", ""},
+		{"set", "2024-03-01", "", "", "", "", "", "", "", "", "Squat", "5", "102.5", "kg", "8.5"},
+		{"set", "2024-03-01", "", "", "", "", "", "", "", "", "Squat", "5", "225", "lb", ""},
+		{"visit", "2024-03-03", "", "", "", "", "", "", "", "", "", "", "", "", ""},
+		{"goal", "", "", "", "", "3", "2024", "150", "2024-01-01", "2024-12-31", "", "", "", "", ""},
+		{"milestone", "", "", "", "", "3", "Halfway", "75", "", "", "", "", "", "", ""},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d:\n%q", len(records), len(want), records)
+	}
+	for i := range want {
+		if !slices.Equal(records[i], want[i]) {
+			t.Errorf("record %d = %q\nwant %q", i, records[i], want[i])
+		}
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := exportJSON(&buf, exportFixture(), time.UTC, exportGoalsFixture()); err != nil {
+		t.Fatal(err)
+	}
+
+	var export struct {
+		Version    int           `json:"version"`
+		ExportedAt time.Time     `json:"exported_at"`
+		Entries    []exportEntry `json:"entries"`
+		Goals      []exportGoal  `json:"goals"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &export); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+
+	if export.Version != exportVersion || export.ExportedAt.IsZero() {
+		t.Errorf("version = %d, exported_at = %v", export.Version, export.ExportedAt)
+	}
+	var dates []string
+	for _, e := range export.Entries {
+		dates = append(dates, e.Date)
+	}
+	if want := []string{"2024-03-01", "2024-03-03"}; !slices.Equal(dates, want) {
+		t.Errorf("entries = %q, want %q", dates, want)
+	}
+	if !reflect.DeepEqual(export.Goals, exportGoalsFixture()) {
+		t.Errorf("goals = %+v, want %+v", export.Goals, exportGoalsFixture())
+	}
+
+	// An export without entries is still valid
+	buf.Reset()
+	if err := exportJSON(&buf, fixedRows(), time.UTC, []exportGoal{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), &export); err != nil || len(export.Entries) != 0 {
+		t.Errorf("empty export = %s, err %v", buf.String(), err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// FIT global message numbers and field numbers read by parseFIT.
+const (
+	fitMsgSession = 18
+	fitMsgRecord  = 20
+
+	fitSessionStartTime    = 2
+	fitSessionElapsedTime  = 7
+	fitSessionDistance     = 9
+	fitSessionAvgHeartRate = 16
+	fitSessionTotalAscent  = 22
+
+	fitRecordAltitude  = 2
+	fitRecordHeartRate = 3
+	fitRecordDistance  = 5
+	fitTimestamp       = 253
+)
+
+// fitEpoch is the zero time of FIT timestamps.
+var fitEpoch = time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
+
+type fitFieldDef struct {
+	num  byte
+	size byte
+}
+
+type fitDefinition struct {
+	global    uint16
+	order     binary.ByteOrder
+	fields    []fitFieldDef
+	devFields int // total size of developer fields, which are skipped
+}
+
+// fitMessage holds the unsigned integer fields of a data message, with
+// invalid (all ones) values left out.
+type fitMessage map[byte]uint64
+
+func readFITValue(b []byte, order binary.ByteOrder) (uint64, bool) {
+	switch len(b) {
+	case 1:
+		return uint64(b[0]), b[0] != 0xFF
+	case 2:
+		v := order.Uint16(b)
+		return uint64(v), v != 0xFFFF
+	case 4:
+		v := order.Uint32(b)
+		return uint64(v), v != 0xFFFFFFFF
+	}
+	return 0, false
+}
+
+// decodeFIT walks the records of a FIT file and calls fn for every data
+// message. Only what's needed for activity summaries is supported: normal
+// and compressed timestamp headers and definitions with developer fields.
+func decodeFIT(data []byte, fn func(global uint16, msg fitMessage)) error {
+	if len(data) < 12 || string(data[8:12]) != ".FIT" {
+		return errors.New("not a FIT file")
+	}
+	headerSize := int(data[0])
+	dataSize := int(binary.LittleEndian.Uint32(data[4:8]))
+	if headerSize < 12 || headerSize+dataSize > len(data) {
+		return errors.New("truncated FIT file")
+	}
+
+	definitions := map[byte]*fitDefinition{}
+	var lastTimestamp uint32
+	pos := headerSize
+	end := headerSize + dataSize
+
+	for pos < end {
+		header := data[pos]
+		pos++
+
+		var local byte
+		compressedOffset := -1
+		switch {
+		case header&0x80 != 0:
+			// Compressed timestamp header, always a data message
+			local = (header >> 5) & 0x03
+			compressedOffset = int(header & 0x1F)
+		case header&0x40 != 0:
+			// Definition message
+			local = header & 0x0F
+			if pos+5 > end {
+				return errors.New("truncated FIT definition")
+			}
+			def := &fitDefinition{order: binary.LittleEndian}
+			if data[pos+1] == 1 {
+				def.order = binary.BigEndian
+			}
+			def.global = def.order.Uint16(data[pos+2 : pos+4])
+			count := int(data[pos+4])
+			pos += 5
+			if pos+count*3 > end {
+				return errors.New("truncated FIT definition")
+			}
+			for i := 0; i < count; i++ {
+				def.fields = append(def.fields, fitFieldDef{num: data[pos], size: data[pos+1]})
+				pos += 3
+			}
+			if header&0x20 != 0 {
+				if pos >= end {
+					return errors.New("truncated FIT definition")
+				}
+				devCount := int(data[pos])
+				pos++
+				if pos+devCount*3 > end {
+					return errors.New("truncated FIT definition")
+				}
+				for i := 0; i < devCount; i++ {
+					def.devFields += int(data[pos+1])
+					pos += 3
+				}
+			}
+			definitions[local] = def
+			continue
+		default:
+			local = header & 0x0F
+		}
+
+		def, ok := definitions[local]
+		if !ok {
+			return errors.New("FIT data message without definition")
+		}
+
+		msg := fitMessage{}
+		for _, f := range def.fields {
+			if pos+int(f.size) > end {
+				return errors.New("truncated FIT data message")
+			}
+			if v, ok := readFITValue(data[pos:pos+int(f.size)], def.order); ok {
+				msg[f.num] = v
+			}
+			pos += int(f.size)
+		}
+		pos += def.devFields
+
+		// Track timestamps so compressed ones can be expanded
+		if ts, ok := msg[fitTimestamp]; ok {
+			lastTimestamp = uint32(ts)
+		} else if compressedOffset >= 0 {
+			ts := lastTimestamp&^0x1F + uint32(compressedOffset)
+			if uint32(compressedOffset) < lastTimestamp&0x1F {
+				ts += 0x20
+			}
+			lastTimestamp = ts
+			msg[fitTimestamp] = uint64(ts)
+		}
+
+		fn(def.global, msg)
+	}
+
+	return nil
+}
+
+// parseFIT summarizes a FIT activity from its session messages, falling
+// back to the individual records if the file has none.
+func parseFIT(data []byte) (*activitySummary, error) {
+	var sessions []fitMessage
+	var track []trackPoint
+
+	err := decodeFIT(data, func(global uint16, msg fitMessage) {
+		switch global {
+		case fitMsgSession:
+			sessions = append(sessions, msg)
+		case fitMsgRecord:
+			ts, ok := msg[fitTimestamp]
+			if !ok {
+				return
+			}
+			p := trackPoint{Time: fitEpoch.Add(time.Duration(ts) * time.Second)}
+			if v, ok := msg[fitRecordAltitude]; ok {
+				alt := float64(v)/5 - 500
+				p.Elevation = &alt
+			}
+			if v, ok := msg[fitRecordHeartRate]; ok {
+				hr := int(v)
+				p.HeartRate = &hr
+			}
+			if v, ok := msg[fitRecordDistance]; ok {
+				dist := float64(v) / 100
+				p.Distance = &dist
+			}
+			track = append(track, p)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sessions) == 0 {
+		return summarizeTrack(track)
+	}
+
+	summary := &activitySummary{}
+	var hrWeighted, hrSeconds float64
+	for _, s := range sessions {
+		if v, ok := s[fitSessionStartTime]; ok {
+			start := fitEpoch.Add(time.Duration(v) * time.Second)
+			if summary.Start.IsZero() || start.Before(summary.Start) {
+				summary.Start = start
+			}
+		}
+		seconds := float64(s[fitSessionElapsedTime]) / 1000
+		summary.Duration += time.Duration(seconds * float64(time.Second))
+		if v, ok := s[fitSessionDistance]; ok {
+			summary.DistanceMeters += float64(v) / 100
+		}
+		if v, ok := s[fitSessionTotalAscent]; ok {
+			summary.ElevationGainMeters += float64(v)
+		}
+		if v, ok := s[fitSessionAvgHeartRate]; ok {
+			hrWeighted += float64(v) * seconds
+			hrSeconds += seconds
+		}
+	}
+	if summary.Start.IsZero() {
+		return nil, errors.New("FIT session has no start time")
+	}
+	if hrSeconds > 0 {
+		hr := int(hrWeighted/hrSeconds + 0.5)
+		summary.AvgHeartRate = &hr
+	}
+
+	// Elevation gain isn't always in the session, work it out from records
+	if summary.ElevationGainMeters == 0 {
+		if fromTrack, err := summarizeTrack(track); err == nil {
+			summary.ElevationGainMeters = fromTrack.ElevationGainMeters
+		}
+	}
+
+	return summary, nil
+}
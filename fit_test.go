@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFIT(t *testing.T) {
+	start := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+	// records.fit starts on a timestamp whose low five bits are 20, so its
+	// compressed timestamps roll over
+	recordsStart := start.Add(-time.Duration(start.Sub(fitEpoch)/time.Second&0x1F)*time.Second + 20*time.Second)
+
+	tests := []struct {
+		file string
+		want *activitySummary
+	}{
+		{
+			// Totals come from the session message
+			file: "activity.fit",
+			want: &activitySummary{
+				Start:               start,
+				Duration:            30 * time.Minute,
+				DistanceMeters:      5000,
+				ElevationGainMeters: 42,
+				AvgHeartRate:        ptr(150),
+			},
+		},
+		{
+			// Big-endian records with a developer field and compressed
+			// timestamps, and no session
+			file: "records.fit",
+			want: &activitySummary{
+				Start:               recordsStart,
+				Duration:            20 * time.Second,
+				DistanceMeters:      60,
+				ElevationGainMeters: 5,
+				AvgHeartRate:        ptr(130),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := parseFIT(readFixture(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSummary(t, got, tt.want)
+		})
+	}
+}
+
+func TestDecodeFIT(t *testing.T) {
+	var globals []uint16
+	var timestamps []uint64
+	err := decodeFIT(readFixture(t, "records.fit"), func(global uint16, msg fitMessage) {
+		globals = append(globals, global)
+		timestamps = append(timestamps, msg[fitTimestamp])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(globals) != 3 {
+		t.Fatalf("got %d messages, want 3", len(globals))
+	}
+	for i, global := range globals {
+		if global != fitMsgRecord {
+			t.Errorf("message %d is global %d, want %d", i, global, fitMsgRecord)
+		}
+		if i > 0 && timestamps[i] != timestamps[0]+uint64(i)*10 {
+			t.Errorf("message %d timestamp = %d, want %d", i, timestamps[i], timestamps[0]+uint64(i)*10)
+		}
+	}
+}
+
+func TestDecodeFITErrors(t *testing.T) {
+	// header returns a 12 byte FIT header for dataSize bytes of records
+	header := func(dataSize byte) []byte {
+		return []byte{12, 0x20, 0, 0, dataSize, 0, 0, 0, '.', 'F', 'I', 'T'}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not fit", []byte("<gpx></gpx> and some padding")},
+		{"too short", []byte(".FIT")},
+		{"data size past the end", header(10)},
+		{"truncated definition", append(header(3), 0x40, 0, 0)},
+		{"data without definition", append(header(2), 0x00, 0x01)},
+		{"truncated data", append(header(10),
+			0x40, 0, 0, 20, 0, 1, 253, 4, 0x86, // record with a timestamp
+			0x00)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := decodeFIT(tt.data, func(uint16, fitMessage) {}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
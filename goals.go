@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// activeGoal returns the user's goal whose period covers today, preferring
+// the most recently started one. Users without one get an open-ended goal
+// of the configured number of visits.
+func activeGoal(db *gorm.DB, user *User) (Goal, error) {
+	today := currentDate(userLocation(user))
+
+	var goal Goal
+	err := db.Where("user_id = ? AND archived = ?", user.ID, false).
+		Where("(start_date IS NULL OR start_date <= ?)", today).
+		Where("(end_date IS NULL OR end_date >= ?)", today).
+		Order("start_date DESC NULLS LAST, id DESC").
+		First(&goal).Error
+	if err == gorm.ErrRecordNotFound {
+		return Goal{UserID: user.ID, Value: currentConfig().Goals.Visits}, nil
+	}
+	return goal, err
+}
+
+// goalVisits scopes a query to the visits counting towards goal, i.e. those
+// within its period.
+func goalVisits(db *gorm.DB, goal Goal) *gorm.DB {
+	query := db.Model(&Entry{}).Where("user_id = ? AND visited = ?", goal.UserID, true)
+	if goal.StartDate != nil {
+		query = query.Where("date >= ?", *goal.StartDate)
+	}
+	if goal.EndDate != nil {
+		query = query.Where("date < ?", goal.EndDate.AddDate(0, 0, 1))
+	}
+	return query
+}
+
+// toGoalResponse describes goal with its outcome so far.
+func toGoalResponse(db *gorm.DB, goal Goal, active Goal, loc *time.Location) (GoalResponse, error) {
+	resp := GoalResponse{
+		ID:       goal.ID,
+		Name:     goal.Name,
+		Value:    goal.Value,
+		Archived: goal.Archived,
+	}
+	if goal.StartDate != nil {
+		start := formatDate(*goal.StartDate)
+		resp.StartDate = &start
+	}
+	if goal.EndDate != nil {
+		end := formatDate(*goal.EndDate)
+		resp.EndDate = &end
+	}
+
+	if err := goalVisits(db, goal).Count(&resp.Visits).Error; err != nil {
+		return resp, err
+	}
+	if goal.Value > 0 {
+		resp.Progress = int(float64(resp.Visits) / float64(goal.Value) * 100)
+	}
+	resp.Achieved = resp.Visits >= int64(goal.Value)
+
+	resp.Status = goalStatus(goal, active, currentDate(loc))
+	return resp, nil
+}
+
+// goalStatus is archived for archived goals, active for the active goal and
+// upcoming for goals that haven't started. Any other goal is inactive: its
+// period is over, or another goal is active for the same days.
+func goalStatus(goal, active Goal, today time.Time) string {
+	switch {
+	case goal.Archived:
+		return "archived"
+	case goal.ID == active.ID:
+		return "active"
+	case goal.StartDate != nil && goal.StartDate.After(today):
+		return "upcoming"
+	default:
+		return "inactive"
+	}
+}
+
+func getGoals(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+		loc := userLocation(user)
+
+		active, err := activeGoal(db, user)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		var goals []Goal
+		if err := db.Where("user_id = ?", user.ID).Order("start_date DESC NULLS LAST, id DESC").Find(&goals).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		response := []GoalResponse{}
+		for _, goal := range goals {
+			resp, err := toGoalResponse(db, goal, active, loc)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			response = append(response, resp)
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// goalPayload is the request body for creating or replacing a goal.
+type goalPayload struct {
+	Name      string `json:"name"`
+	Value     int    `json:"value"`
+	Year      int    `json:"year"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Archived  bool   `json:"archived"`
+}
+
+// apply validates the payload and copies it onto goal, returning a
+// user-facing message when it is invalid.
+func (p *goalPayload) apply(goal *Goal) string {
+	if p.Value <= 0 {
+		return "value must be positive"
+	}
+
+	goal.Name = strings.TrimSpace(p.Name)
+	goal.Value = p.Value
+	goal.Archived = p.Archived
+	goal.StartDate = nil
+	goal.EndDate = nil
+
+	// A year is shorthand for January 1 to December 31
+	if p.Year != 0 {
+		if p.StartDate != "" || p.EndDate != "" {
+			return "use either year or start_date/end_date"
+		}
+		p.StartDate = fmt.Sprintf("%04d-01-01", p.Year)
+		p.EndDate = fmt.Sprintf("%04d-12-31", p.Year)
+		if goal.Name == "" {
+			goal.Name = fmt.Sprintf("%d", p.Year)
+		}
+	}
+
+	if p.StartDate != "" {
+		start, err := parseDate(p.StartDate)
+		if err != nil {
+			return "invalid start_date format, use YYYY-MM-DD"
+		}
+		goal.StartDate = &start
+	}
+	if p.EndDate != "" {
+		end, err := parseDate(p.EndDate)
+		if err != nil {
+			return "invalid end_date format, use YYYY-MM-DD"
+		}
+		goal.EndDate = &end
+	}
+	if goal.StartDate != nil && goal.EndDate != nil && goal.EndDate.Before(*goal.StartDate) {
+		return "end_date must not be before start_date"
+	}
+
+	return ""
+}
+
+// goalForID loads the caller's goal identified by the :id path parameter. It
+// writes the error response itself and returns false if there is none.
+func goalForID(c *gin.Context, db *gorm.DB, user *User) (*Goal, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid goal id"})
+		return nil, false
+	}
+
+	var goal Goal
+	if err := db.Where("user_id = ?", user.ID).First(&goal, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "goal not found"})
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+
+	return &goal, true
+}
+
+// respondWithGoal writes goal with its outcome and milestones.
+func respondWithGoal(c *gin.Context, db *gorm.DB, user *User, goal *Goal, status int) {
+	active, err := activeGoal(db, user)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	resp, err := toGoalResponse(db, *goal, active, userLocation(user))
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	resp.Milestones = []Milestone{}
+	if err := db.Where("goal_id = ?", goal.ID).Order("target ASC").Find(&resp.Milestones).Error; err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(status, resp)
+}
+
+func getGoal(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, ok := goalForID(c, db, user)
+		if !ok {
+			return
+		}
+
+		respondWithGoal(c, db, user, goal, http.StatusOK)
+	}
+}
+
+func postGoal(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		var payload goalPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		goal := Goal{UserID: user.ID}
+		if msg := payload.apply(&goal); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		if err := db.Create(&goal).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		respondWithGoal(c, db, user, &goal, http.StatusCreated)
+	}
+}
+
+func updateGoal(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, ok := goalForID(c, db, user)
+		if !ok {
+			return
+		}
+
+		var payload goalPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if msg := payload.apply(goal); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		// Milestones must stay within the goal
+		var maxTarget int
+		if err := db.Model(&Milestone{}).Where("goal_id = ?", goal.ID).Select("COALESCE(MAX(target), 0)").Scan(&maxTarget).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+		if maxTarget > goal.Value {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("value must be at least %d, the highest milestone target", maxTarget)})
+			return
+		}
+
+		if err := db.Select("Name", "Value", "StartDate", "EndDate", "Archived").Updates(goal).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		respondWithGoal(c, db, user, goal, http.StatusOK)
+	}
+}
+
+func deleteGoal(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, ok := goalForID(c, db, user)
+		if !ok {
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("goal_id = ?", goal.ID).Delete(&Milestone{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(goal).Error
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "goal deleted"})
+	}
+}
+
+// weeklyGoalAt returns the weekly goal that was in force for the week
+// starting at weekStart.
+func weeklyGoalAt(db *gorm.DB, userID uint, weekStart time.Time) (int, error) {
+	var goal WeeklyGoal
+	err := db.Where("user_id = ? AND effective_from <= ?", userID, weekStart).
+		Order("effective_from DESC, id DESC").
+		First(&goal).Error
+	if err == gorm.ErrRecordNotFound {
+		return currentConfig().Goals.Weekly, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return goal.Value, nil
+}
+
+func getWeeklyGoal(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		current, err := weeklyGoalAt(db, user.ID, startOfWeek(currentDate(userLocation(user))))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		history := []WeeklyGoal{}
+		if err := db.Where("user_id = ?", user.ID).Order("effective_from ASC").Find(&history).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"weekly_goal": current,
+			"history":     history,
+		})
+	}
+}
+
+func putWeeklyGoal(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		var payload struct {
+			Value int `json:"value"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if payload.Value < 1 || payload.Value > 7 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "value must be between 1 and 7"})
+			return
+		}
+
+		// The new goal applies from the start of the current week, so past
+		// weeks keep being evaluated against the goal they had
+		weekStart := startOfWeek(currentDate(userLocation(user)))
+
+		var goal WeeklyGoal
+		err := db.Where("user_id = ? AND effective_from = ?", user.ID, weekStart).First(&goal).Error
+		if err == nil {
+			// Changed again within the same week, replace that week's goal
+			if err := db.Model(&goal).Update("value", payload.Value).Error; err != nil {
+				internalError(c, err)
+				return
+			}
+		} else if err == gorm.ErrRecordNotFound {
+			goal = WeeklyGoal{UserID: user.ID, Value: payload.Value, EffectiveFrom: weekStart}
+			if err := db.Create(&goal).Error; err != nil {
+				internalError(c, err)
+				return
+			}
+		} else {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "weekly goal updated",
+			"weekly_goal":    payload.Value,
+			"effective_from": weekStart.Format("2006-01-02"),
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGoalStatus(t *testing.T) {
+	today := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	day := func(month time.Month, d int) *time.Time { return ptr(time.Date(2026, month, d, 0, 0, 0, 0, time.UTC)) }
+	active := Goal{ID: 1, StartDate: day(3, 1), EndDate: day(12, 31)}
+
+	tests := []struct {
+		name string
+		goal Goal
+		want string
+	}{
+		{"active", active, "active"},
+		{"archived", Goal{ID: 2, StartDate: day(1, 1), Archived: true}, "archived"},
+		{"archived before it starts", Goal{ID: 2, StartDate: day(11, 1), Archived: true}, "archived"},
+		{"upcoming", Goal{ID: 2, StartDate: day(11, 1)}, "upcoming"},
+		{"ended", Goal{ID: 2, StartDate: day(1, 1), EndDate: day(6, 30)}, "inactive"},
+		{"overlapping the active goal", Goal{ID: 2, StartDate: day(1, 1), EndDate: day(12, 31)}, "inactive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := goalStatus(tt.goal, active, today); got != tt.want {
+				t.Errorf("status = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,108 +1,226 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+func toEntryResponse(e Entry, loc *time.Location) EntryResponse {
+	entry := EntryResponse{
+		Date:    midnightIn(e.Date, loc),
+		Visited: e.Visited,
+	}
+	entry.Sessions = []SessionResponse{}
+	for _, s := range e.Sessions {
+		session := toSessionResponse(s, loc)
+		if entry.Workout == nil && session.Workout != nil {
+			entry.Workout = session.Workout
+		}
+		entry.Sessions = append(entry.Sessions, session)
+	}
+	for _, s := range e.Sets {
+		entry.Sets = append(entry.Sets, toSetResponse(s))
+	}
+	return entry
+}
+
 func getEntries(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var entries []Entry
-		if err := db.Preload("Workout").Find(&entries).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+		loc := userLocation(user)
+
+		// Nested sets are only loaded when asked for with ?include=sets
+		includeSets := c.Query("include") == "sets"
+
+		// Sort by date, oldest first unless ?sort=desc
+		descending := false
+		switch c.DefaultQuery("sort", "asc") {
+		case "asc":
+		case "desc":
+			descending = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be asc or desc"})
 			return
 		}
 
-		// Transform to response with workout name only
-		var response []EntryResponse
-		for _, e := range entries {
-			entry := EntryResponse{
-				Date:    e.Date,
-				Visited: e.Visited,
+		// Paginate only when asked to, older clients expect a plain array
+		paginate := c.Query("limit") != "" || c.Query("cursor") != ""
+		limit := defaultPageSize
+		if value := c.Query("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxPageSize {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+				return
 			}
-			if e.Workout != nil {
-				entry.Workout = &e.Workout.Name
+			limit = n
+		}
+
+		filtered, err := entryFilters(c, db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Total of all matching entries, regardless of the page
+		var total int64
+		if err := filtered.Session(&gorm.Session{}).Model(&Entry{}).Count(&total).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+		c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+
+		query := preloadSessions(filtered.Session(&gorm.Session{}))
+		if includeSets {
+			query = query.Preload("Sets", func(db *gorm.DB) *gorm.DB {
+				return db.Order("set_order ASC, id ASC")
+			}).Preload("Sets.Exercise")
+		}
+		if descending {
+			query = query.Order("entries.date DESC, entries.id DESC")
+		} else {
+			query = query.Order("entries.date ASC, entries.id ASC")
+		}
+
+		if value := c.Query("cursor"); value != "" {
+			cursor, err := decodeEntryCursor(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
 			}
-			response = append(response, entry)
+			if descending {
+				query = query.Where("(entries.date < ? OR (entries.date = ? AND entries.id < ?))", cursor.Date, cursor.Date, cursor.ID)
+			} else {
+				query = query.Where("(entries.date > ? OR (entries.date = ? AND entries.id > ?))", cursor.Date, cursor.Date, cursor.ID)
+			}
+		}
+
+		// Fetch one extra row to know whether another page follows
+		if paginate {
+			query = query.Limit(limit + 1)
 		}
 
-		c.JSON(http.StatusOK, response)
+		var entries []Entry
+		if err := query.Find(&entries).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		var nextCursor *string
+		if paginate && len(entries) > limit {
+			entries = entries[:limit]
+			last := entries[len(entries)-1]
+			next := entryCursor{Date: last.Date, ID: last.ID}.encode()
+			nextCursor = &next
+		}
+
+		// Transform to response with workout names only, dated in the user's timezone
+		response := []EntryResponse{}
+		for _, e := range entries {
+			response = append(response, toEntryResponse(e, loc))
+		}
+
+		if !paginate {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"entries":     response,
+			"next_cursor": nextCursor,
+		})
 	}
 }
 
 func postEntry(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-API-Key")
-		expectedKey := os.Getenv("API_KEY")
-		if expectedKey == "" {
-			expectedKey = "default-secret" // for development
-		}
-		if apiKey != expectedKey {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			return
-		}
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
 
+		// Session fields are optional and add a session to the day
 		var payload struct {
 			Date string `json:"date"`
+			sessionPayload
 		}
 		if err := c.ShouldBindJSON(&payload); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		date, err := time.Parse("2006-01-02", payload.Date)
+		loc := userLocation(user)
+		date, err := parseDate(payload.Date)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
 			return
 		}
 
-		// Check if entry already exists for this date
-		var existing Entry
-		if err := db.Where("date = ?", date).First(&existing).Error; err == nil {
-			// Entry exists, return success (idempotent)
-			c.JSON(http.StatusOK, gin.H{"message": "entry already exists"})
-			return
-		} else if err != gorm.ErrRecordNotFound {
-			// Some other error
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		var session *Session
+		if !payload.empty() {
+			session = &Session{}
+			if msg := payload.apply(session, date, loc); msg != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+				return
+			}
+			if session.WorkoutID != nil && !checkWorkout(c, db, user, *session.WorkoutID, nil) {
+				return
+			}
 		}
 
+		// The day's entry is created unless it already exists, in which case
+		// the session is added to it
 		entry := Entry{
-			Date:      date,
-			Visited:   true,
-			WorkoutID: nil,
-		}
-
-		if err := db.Create(&entry).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			UserID:  user.ID,
+			Date:    date,
+			Visited: true,
+		}
+		created := false
+		err = db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry)
+			if result.Error != nil {
+				return result.Error
+			}
+			created = result.RowsAffected > 0
+			if !created {
+				if err := onDay(tx, user.ID, date).First(&entry).Error; err != nil {
+					return err
+				}
+			}
+			if session == nil {
+				return nil
+			}
+			session.EntryID = entry.ID
+			return tx.Create(session).Error
+		})
+		if err != nil {
+			internalError(c, err)
 			return
 		}
 
-		c.JSON(http.StatusCreated, gin.H{"message": "entry added"})
+		switch {
+		case !created && session == nil:
+			// Entry exists, return success (idempotent)
+			c.JSON(http.StatusOK, gin.H{"message": "entry already exists"})
+		case !created:
+			// Another session on a day that was already visited
+			c.JSON(http.StatusCreated, gin.H{"message": "session added"})
+		default:
+			c.JSON(http.StatusCreated, gin.H{"message": "entry added"})
+		}
 	}
 }
 
 func updateEntryWorkout(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-API-Key")
-		expectedKey := os.Getenv("API_KEY")
-		if expectedKey == "" {
-			expectedKey = "default-secret"
-		}
-		if apiKey != expectedKey {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			return
-		}
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
 
 		var payload struct {
 			Date      string `json:"date"`
@@ -113,43 +231,49 @@ func updateEntryWorkout(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		date, err := time.Parse("2006-01-02", payload.Date)
+		date, err := parseDate(payload.Date)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
 			return
 		}
 
 		// Verify workout exists
-		var workout Workout
-		if err := db.First(&workout, payload.WorkoutID).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "workout not found"})
-				return
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if !checkWorkout(c, db, user, payload.WorkoutID, nil) {
 			return
 		}
 
 		// Find entry for the given date
 		var entry Entry
-		if err := db.Where("date = ?", date).First(&entry).Error; err != nil {
+		if err := preloadSessions(onDay(db, user.ID, date)).First(&entry).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				c.JSON(http.StatusNotFound, gin.H{"error": "no entry found for this date"})
 				return
 			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
 			return
 		}
 
-		// Check if workout is already set
-		if entry.WorkoutID != nil {
-			c.JSON(http.StatusOK, gin.H{"message": "workout already set for this entry"})
-			return
+		// Check if workout is already set on any session
+		var blank *Session
+		for i := range entry.Sessions {
+			if entry.Sessions[i].WorkoutID != nil {
+				c.JSON(http.StatusOK, gin.H{"message": "workout already set for this entry"})
+				return
+			}
+			if blank == nil {
+				blank = &entry.Sessions[i]
+			}
 		}
 
-		// Update the workout_id
-		if err := db.Model(&entry).Update("workout_id", payload.WorkoutID).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		// Fill in the first session without a workout, or start one
+		if blank != nil {
+			err = db.Model(blank).Update("workout_id", payload.WorkoutID).Error
+		} else {
+			workoutID := payload.WorkoutID
+			err = db.Create(&Session{EntryID: entry.ID, WorkoutID: &workoutID}).Error
+		}
+		if err != nil {
+			internalError(c, err)
 			return
 		}
 
@@ -157,16 +281,141 @@ func updateEntryWorkout(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+func patchEntry(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+
+		// Decode into raw fields so an explicit null can be told apart from
+		// a field that was left out
+		var payload map[string]json.RawMessage
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var sessions []Session
+		if err := db.Where("entry_id = ?", entry.ID).Find(&sessions).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		updated := false
+		for field, raw := range payload {
+			switch field {
+			case "workout_id":
+				var workoutID *uint
+				if err := json.Unmarshal(raw, &workoutID); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "workout_id must be a number or null"})
+					return
+				}
+
+				// The day's workout is only unambiguous with at most one session
+				if len(sessions) > 1 {
+					c.JSON(http.StatusConflict, gin.H{"error": "entry has multiple sessions, use /entry/{date}/sessions"})
+					return
+				}
+
+				// Verify workout exists, null clears it
+				var current *uint
+				if len(sessions) == 1 {
+					current = sessions[0].WorkoutID
+				}
+				if workoutID != nil && !checkWorkout(c, db, user, *workoutID, current) {
+					return
+				}
+
+				var err error
+				if len(sessions) == 1 {
+					err = db.Model(&sessions[0]).Update("workout_id", workoutID).Error
+				} else if workoutID != nil {
+					err = db.Create(&Session{EntryID: entry.ID, WorkoutID: workoutID}).Error
+				}
+				if err != nil {
+					internalError(c, err)
+					return
+				}
+				updated = true
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown field %q", field)})
+				return
+			}
+		}
+		if !updated {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to update"})
+			return
+		}
+
+		if err := preloadSessions(db).First(entry, entry.ID).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, toEntryResponse(*entry, userLocation(user)))
+	}
+}
+
+func deleteEntry(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+
+		// Records are rebuilt in the same transaction, so they never point
+		// at deleted sets
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var exerciseIDs []uint
+			if err := tx.Model(&SetLog{}).Where("entry_id = ?", entry.ID).Distinct().Pluck("exercise_id", &exerciseIDs).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("entry_id = ?", entry.ID).Delete(&SetLog{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("entry_id = ?", entry.ID).Delete(&Session{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(entry).Error; err != nil {
+				return err
+			}
+			for _, exerciseID := range exerciseIDs {
+				if err := recomputeRecords(tx, user.ID, exerciseID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "entry deleted"})
+	}
+}
+
 func healthHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
 		// Check database connectivity
 		sqlDB, err := db.DB()
 		if err != nil {
+			_ = c.Error(err)
 			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy", "error": "database connection error"})
 			return
 		}
 
-		if err := sqlDB.Ping(); err != nil {
+		if err := sqlDB.PingContext(c.Request.Context()); err != nil {
+			_ = c.Error(err)
 			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy", "error": "database ping failed"})
 			return
 		}
@@ -175,28 +424,37 @@ func healthHandler(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// goalProgress counts the visits towards the user's active goal and how far
+// along it they are in percent.
+func goalProgress(db *gorm.DB, user *User) (Goal, int64, int, error) {
+	// If no goal is active, this defaults to 100
+	goal, err := activeGoal(db, user)
+	if err != nil {
+		return goal, 0, 0, err
+	}
+
+	// Only visits within the goal's period count towards it
+	var count int64
+	if err := goalVisits(db, goal).Count(&count).Error; err != nil {
+		return goal, 0, 0, err
+	}
+
+	percent := 0
+	if goal.Value > 0 {
+		percent = int(float64(count) / float64(goal.Value) * 100)
+	}
+	return goal, count, percent, nil
+}
+
 func getProgressMessage(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var count int64
-		if err := db.Model(&Entry{}).Where("visited = ?", true).Count(&count).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		var goal Goal
-		if err := db.First(&goal).Error; err != nil {
-			// If no goal exists, default to 100
-			if err == gorm.ErrRecordNotFound {
-				goal.Value = 100
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-		}
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
 
-		percent := 0
-		if goal.Value > 0 {
-			percent = int(float64(count) / float64(goal.Value) * 100)
+		goal, count, percent, err := goalProgress(db, user)
+		if err != nil {
+			internalError(c, err)
+			return
 		}
 
 		var message string
@@ -218,16 +476,48 @@ func getProgressMessage(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// streakStatus returns the streak ending at the user's most recent visit
+// and the days since that visit, which is -1 if they have no visits.
+func streakStatus(db *gorm.DB, user *User) (int, int, error) {
+	// Get all entries ordered by date descending
+	var entries []Entry
+	if err := db.Where("user_id = ? AND visited = ?", user.ID, true).Order("date DESC").Find(&entries).Error; err != nil {
+		return 0, 0, err
+	}
+	if len(entries) == 0 {
+		return 0, -1, nil
+	}
+
+	// Days since the last visit count from today in the user's timezone
+	days := visitDays(entries)
+	daysSinceLastVisit := daysBetween(days[0], currentDate(userLocation(user)))
+
+	// Count consecutive days from most recent visit
+	return recentStreak(days), daysSinceLastVisit, nil
+}
+
+// activeStreak is the user's streak if it is still alive, i.e. they last
+// visited today or yesterday, and 0 otherwise.
+func activeStreak(db *gorm.DB, user *User) (int, error) {
+	streak, daysSinceLastVisit, err := streakStatus(db, user)
+	if err != nil || daysSinceLastVisit < 0 || daysSinceLastVisit > 1 {
+		return 0, err
+	}
+	return streak, nil
+}
+
 func getStreak(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get all entries ordered by date descending
-		var entries []Entry
-		if err := db.Where("visited = ?", true).Order("date DESC").Find(&entries).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		streak, daysSinceLastVisit, err := streakStatus(db, user)
+		if err != nil {
+			internalError(c, err)
 			return
 		}
 
-		if len(entries) == 0 {
+		if daysSinceLastVisit < 0 {
 			c.JSON(http.StatusOK, gin.H{
 				"emoji":   "🎯",
 				"tooltip": "Ready to begin? Your streak starts today!",
@@ -235,23 +525,6 @@ func getStreak(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Calculate streak
-		today := time.Now().Truncate(24 * time.Hour)
-		lastVisit := entries[0].Date.Truncate(24 * time.Hour)
-		daysSinceLastVisit := int(today.Sub(lastVisit).Hours() / 24)
-
-		// Count consecutive days from most recent visit
-		streak := 1
-		for i := 1; i < len(entries); i++ {
-			expected := entries[i-1].Date.Truncate(24*time.Hour).AddDate(0, 0, -1)
-			actual := entries[i].Date.Truncate(24 * time.Hour)
-			if expected.Equal(actual) {
-				streak++
-			} else {
-				break
-			}
-		}
-
 		var emoji, tooltip string
 
 		if daysSinceLastVisit > 1 {
@@ -285,22 +558,21 @@ func getStreak(db *gorm.DB) gin.HandlerFunc {
 
 func getStats(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get total visits
-		var totalVisits int64
-		if err := db.Model(&Entry{}).Where("visited = ?", true).Count(&totalVisits).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		// Get active goal
+		goal, err := activeGoal(db, user)
+		if err != nil {
+			internalError(c, err)
 			return
 		}
 
-		// Get goal
-		var goal Goal
-		if err := db.First(&goal).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				goal.Value = 100
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+		// Get total visits within the goal's period
+		var totalVisits int64
+		if err := goalVisits(db, goal).Count(&totalVisits).Error; err != nil {
+			internalError(c, err)
+			return
 		}
 
 		// Calculate progress percentage
@@ -311,94 +583,59 @@ func getStats(db *gorm.DB) gin.HandlerFunc {
 
 		// Get all entries ordered by date for streak calculation
 		var entries []Entry
-		if err := db.Where("visited = ?", true).Order("date DESC").Find(&entries).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		currentStreak := 0
-		longestStreak := 0
-
-		if len(entries) > 0 {
-			// Calculate current streak
-			today := time.Now().Truncate(24 * time.Hour)
-			lastVisit := entries[0].Date.Truncate(24 * time.Hour)
-			daysSinceLastVisit := int(today.Sub(lastVisit).Hours() / 24)
-
-			if daysSinceLastVisit <= 1 {
-				// Streak is active
-				currentStreak = 1
-				for i := 1; i < len(entries); i++ {
-					expected := entries[i-1].Date.Truncate(24*time.Hour).AddDate(0, 0, -1)
-					actual := entries[i].Date.Truncate(24 * time.Hour)
-					if expected.Equal(actual) {
-						currentStreak++
-					} else {
-						break
-					}
-				}
-			}
-
-			// Calculate longest streak by checking all entries
-			// Sort entries by date ascending for easier calculation
-			var entriesAsc []Entry
-			if err := db.Where("visited = ?", true).Order("date ASC").Find(&entriesAsc).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-
-			if len(entriesAsc) > 0 {
-				tempStreak := 1
-				longestStreak = 1
-				for i := 1; i < len(entriesAsc); i++ {
-					prevDate := entriesAsc[i-1].Date.Truncate(24 * time.Hour)
-					currDate := entriesAsc[i].Date.Truncate(24 * time.Hour)
-					expectedNext := prevDate.AddDate(0, 0, 1)
-					if expectedNext.Equal(currDate) {
-						tempStreak++
-					} else {
-						if tempStreak > longestStreak {
-							longestStreak = tempStreak
-						}
-						tempStreak = 1
-					}
-				}
-				if tempStreak > longestStreak {
-					longestStreak = tempStreak
-				}
-			}
+		if err := db.Where("user_id = ? AND visited = ?", user.ID, true).Order("date DESC").Find(&entries).Error; err != nil {
+			internalError(c, err)
+			return
 		}
 
+		// Calculate current and longest streaks, the current one ending today
+		// in the user's timezone
+		days := visitDays(entries)
+		current := currentStreak(days, time.Now(), userLocation(user))
+		longest := longestStreak(days)
+
 		c.JSON(http.StatusOK, gin.H{
 			"goal":          goal.Value,
 			"total":         totalVisits,
 			"progress":      progress,
-			"currentStreak": fmt.Sprintf("%d days", currentStreak),
-			"longestStreak": fmt.Sprintf("%d days", longestStreak),
+			"currentStreak": fmt.Sprintf("%d days", current),
+			"longestStreak": fmt.Sprintf("%d days", longest),
 		})
 	}
 }
 
 func getWeeklyStats(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Calculate start of current week (Monday)
-		now := time.Now()
-		weekday := int(now.Weekday())
-		if weekday == 0 {
-			weekday = 7 // Sunday becomes 7
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		// Calculate start of the week (Monday) in the user's timezone, either
+		// the current one or the week containing ?week=YYYY-MM-DD
+		day := currentDate(userLocation(user))
+		if week := c.Query("week"); week != "" {
+			date, err := parseDate(week)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
+				return
+			}
+			day = date
 		}
-		startOfWeek := now.AddDate(0, 0, -(weekday - 1)).Truncate(24 * time.Hour)
-		endOfWeek := startOfWeek.AddDate(0, 0, 7)
+		weekStart := startOfWeek(day)
+		weekEnd := weekStart.AddDate(0, 0, 7)
 
 		// Count workouts completed this week
 		var workoutsCompleted int64
-		if err := db.Model(&Entry{}).Where("visited = ? AND date >= ? AND date < ?", true, startOfWeek, endOfWeek).Count(&workoutsCompleted).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err := db.Model(&Entry{}).Where("user_id = ? AND visited = ? AND date >= ? AND date < ?", user.ID, true, weekStart, weekEnd).Count(&workoutsCompleted).Error; err != nil {
+			internalError(c, err)
 			return
 		}
 
-		// Weekly goal (hardcoded for now)
-		weeklyGoal := 5
+		// Evaluate against the weekly goal in force that week
+		weeklyGoal, err := weeklyGoalAt(db, user.ID, weekStart)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
 
 		// Calculate progress percentage
 		percent := 0
@@ -425,24 +662,51 @@ func getWeeklyStats(db *gorm.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{
 			"workouts_completed": workoutsCompleted,
 			"weekly_goal":        weeklyGoal,
+			"week_start":         weekStart.Format("2006-01-02"),
 			"progress_message":   message,
 		})
 	}
 }
 
+// milestoneStatus returns the visits towards the user's active goal, the
+// goal's milestones ordered by target and the next one to reach, which is
+// nil once all of them are.
+func milestoneStatus(db *gorm.DB, user *User) (int64, []Milestone, *Milestone, error) {
+	// Get active goal
+	goal, err := activeGoal(db, user)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	// Get total visits within the goal's period
+	var totalVisits int64
+	if err := goalVisits(db, goal).Count(&totalVisits).Error; err != nil {
+		return 0, nil, nil, err
+	}
+
+	// Get the active goal's milestones ordered by target
+	var milestones []Milestone
+	if err := db.Where("user_id = ? AND goal_id = ?", user.ID, goal.ID).Order("target ASC").Find(&milestones).Error; err != nil {
+		return 0, nil, nil, err
+	}
+
+	// Find the next milestone
+	for i := range milestones {
+		if int64(milestones[i].Target) > totalVisits {
+			return totalVisits, milestones, &milestones[i], nil
+		}
+	}
+	return totalVisits, milestones, nil, nil
+}
+
 func getMilestoneProgress(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get total visits
-		var totalVisits int64
-		if err := db.Model(&Entry{}).Where("visited = ?", true).Count(&totalVisits).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
 
-		// Get all milestones ordered by target
-		var milestones []Milestone
-		if err := db.Order("target ASC").Find(&milestones).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		totalVisits, milestones, nextMilestone, err := milestoneStatus(db, user)
+		if err != nil {
+			internalError(c, err)
 			return
 		}
 
@@ -454,15 +718,6 @@ func getMilestoneProgress(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Find the next milestone
-		var nextMilestone *Milestone
-		for i := range milestones {
-			if int64(milestones[i].Target) > totalVisits {
-				nextMilestone = &milestones[i]
-				break
-			}
-		}
-
 		var message string
 		var milestoneTarget int
 		var remaining int64
@@ -494,27 +749,26 @@ func getMilestoneProgress(db *gorm.DB) gin.HandlerFunc {
 
 func getForecast(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get total visits
-		var totalVisits int64
-		if err := db.Model(&Entry{}).Where("visited = ?", true).Count(&totalVisits).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		// Get active goal
+		goal, err := activeGoal(db, user)
+		if err != nil {
+			internalError(c, err)
 			return
 		}
 
-		// Get goal
-		var goal Goal
-		if err := db.First(&goal).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				goal.Value = 100
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+		// Get total visits within the goal's period
+		var totalVisits int64
+		if err := goalVisits(db, goal).Count(&totalVisits).Error; err != nil {
+			internalError(c, err)
+			return
 		}
 
-		// Get first entry date to calculate weeks elapsed
+		// Get first entry date within the period to calculate weeks elapsed
 		var firstEntry Entry
-		if err := db.Where("visited = ?", true).Order("date ASC").First(&firstEntry).Error; err != nil {
+		if err := goalVisits(db, goal).Order("date ASC").First(&firstEntry).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				c.JSON(http.StatusOK, gin.H{
 					"current_progress": "No workouts yet - start your journey today!",
@@ -522,13 +776,18 @@ func getForecast(db *gorm.DB) gin.HandlerFunc {
 				})
 				return
 			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			internalError(c, err)
 			return
 		}
 
-		// Calculate weeks elapsed since first workout
+		// Calculate weeks elapsed since first workout, or since the period
+		// started if that was earlier
 		now := time.Now()
-		daysElapsed := now.Sub(firstEntry.Date).Hours() / 24
+		since := firstEntry.Date
+		if goal.StartDate != nil && goal.StartDate.Before(since) {
+			since = *goal.StartDate
+		}
+		daysElapsed := now.Sub(since).Hours() / 24
 		weeksElapsed := daysElapsed / 7
 		if weeksElapsed < 1 {
 			weeksElapsed = 1 // Minimum 1 week to avoid division issues
@@ -557,7 +816,14 @@ func getForecast(db *gorm.DB) gin.HandlerFunc {
 			remainingWorkouts := int64(goal.Value) - totalVisits
 			weeksToGoal := float64(remainingWorkouts) / avgPerWeek
 			completionDate := now.AddDate(0, 0, int(weeksToGoal*7))
-			futureForecast = fmt.Sprintf("📅 At this pace, you'll hit your goal of %d by %s!", goal.Value, completionDate.Format("January 2, 2006"))
+			if goal.EndDate != nil && completionDate.After(goal.EndDate.AddDate(0, 0, 1)) {
+				// The period ends first, project where it will end up
+				weeksLeft := goal.EndDate.AddDate(0, 0, 1).Sub(now).Hours() / 24 / 7
+				projected := totalVisits + int64(avgPerWeek*weeksLeft)
+				futureForecast = fmt.Sprintf("⏳ At this pace, you'll reach %d of %d by %s - time to pick up the pace!", projected, goal.Value, goal.EndDate.UTC().Format("January 2, 2006"))
+			} else {
+				futureForecast = fmt.Sprintf("📅 At this pace, you'll hit your goal of %d by %s!", goal.Value, completionDate.Format("January 2, 2006"))
+			}
 		} else {
 			futureForecast = "Keep working out to see your forecast!"
 		}
@@ -571,19 +837,21 @@ func getForecast(db *gorm.DB) gin.HandlerFunc {
 
 func getAIStats(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Gather data points from DB
-		var totalVisits int64
-		db.Model(&Entry{}).Where("visited = ?", true).Count(&totalVisits)
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
 
-		var goal Goal
-		db.First(&goal)
+		// Gather data points from DB
+		goal, _ := activeGoal(db, user)
 		if goal.Value == 0 {
-			goal.Value = 100
+			goal.Value = currentConfig().Goals.Visits
 		}
 
+		var totalVisits int64
+		goalVisits(db, goal).Count(&totalVisits)
+
 		// Get first entry date
 		var firstEntry Entry
-		db.Where("visited = ?", true).Order("date ASC").First(&firstEntry)
+		goalVisits(db, goal).Order("date ASC").First(&firstEntry)
 
 		// Calculate weeks since start
 		weeksActive := 1.0
@@ -602,44 +870,24 @@ func getAIStats(db *gorm.DB) gin.HandlerFunc {
 			Count int64
 		}
 		var workoutCounts []WorkoutCount
-		db.Table("entries").
+		db.Table("sessions").
 			Select("workouts.name, COUNT(*) as count").
-			Joins("LEFT JOIN workouts ON entries.workout_id = workouts.id").
-			Where("entries.workout_id IS NOT NULL").
+			Joins("JOIN entries ON entries.id = sessions.entry_id").
+			Joins("LEFT JOIN workouts ON sessions.workout_id = workouts.id").
+			Where("entries.user_id = ? AND sessions.workout_id IS NOT NULL", user.ID).
 			Group("workouts.name").
 			Scan(&workoutCounts)
 
 		// Calculate current streak
 		var entries []Entry
-		db.Where("visited = ?", true).Order("date DESC").Find(&entries)
-		currentStreak := 0
-		if len(entries) > 0 {
-			today := time.Now().Truncate(24 * time.Hour)
-			lastVisit := entries[0].Date.Truncate(24 * time.Hour)
-			daysSinceLastVisit := int(today.Sub(lastVisit).Hours() / 24)
-			if daysSinceLastVisit <= 1 {
-				currentStreak = 1
-				for i := 1; i < len(entries); i++ {
-					expected := entries[i-1].Date.Truncate(24*time.Hour).AddDate(0, 0, -1)
-					actual := entries[i].Date.Truncate(24 * time.Hour)
-					if expected.Equal(actual) {
-						currentStreak++
-					} else {
-						break
-					}
-				}
-			}
-		}
+		db.Where("user_id = ? AND visited = ?", user.ID, true).Order("date DESC").Find(&entries)
+		loc := userLocation(user)
+		streak := currentStreak(visitDays(entries), time.Now(), loc)
 
 		// Get this week's workouts
-		now := time.Now()
-		weekday := int(now.Weekday())
-		if weekday == 0 {
-			weekday = 7
-		}
-		startOfWeek := now.AddDate(0, 0, -(weekday - 1)).Truncate(24 * time.Hour)
+		weekStart := startOfWeek(currentDate(loc))
 		var weeklyWorkouts int64
-		db.Model(&Entry{}).Where("visited = ? AND date >= ?", true, startOfWeek).Count(&weeklyWorkouts)
+		db.Model(&Entry{}).Where("user_id = ? AND visited = ? AND date >= ?", user.ID, true, weekStart).Count(&weeklyWorkouts)
 
 		// Build workout distribution string
 		workoutDist := ""
@@ -662,44 +910,16 @@ Data:
 
 Respond with exactly 1 short one-liner. No numbering, no bullets.`,
 			totalVisits, goal.Value, int(float64(totalVisits)/float64(goal.Value)*100),
-			avgPerWeek, currentStreak, weeklyWorkouts, workoutDist, weeksActive)
-
-		// Call Ollama API
-		ollamaURL := os.Getenv("OLLAMA_URL")
-		if ollamaURL == "" {
-			ollamaURL = "http://localhost:11434"
-		}
-
-		reqBody := map[string]interface{}{
-			"model":  "deepseek-r1",
-			"prompt": prompt,
-			"stream": false,
-		}
-		jsonBody, _ := json.Marshal(reqBody)
+			avgPerWeek, streak, weeklyWorkouts, workoutDist, weeksActive)
 
-		resp, err := http.Post(ollamaURL+"/api/generate", "application/json", bytes.NewBuffer(jsonBody))
+		response, err := ollamaGenerate(c.Request.Context(), prompt)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to Ollama: " + err.Error()})
-			return
-		}
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
-			return
-		}
-
-		var ollamaResp struct {
-			Response string `json:"response"`
-		}
-		if err := json.Unmarshal(body, &ollamaResp); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse response"})
+			internalError(c, err)
 			return
 		}
 
 		// Split response into array of insights
-		lines := strings.Split(strings.TrimSpace(ollamaResp.Response), "\n")
+		lines := strings.Split(strings.TrimSpace(response), "\n")
 		var insights []string
 		for _, line := range lines {
 			line = strings.TrimSpace(line)
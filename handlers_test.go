@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// entryDB is a database with one entry, whose only session is of workout
+// 3, and workout 4. It records the workout_id of every update.
+func entryDB(t *testing.T, updates *[]any) *gorm.DB {
+	t.Helper()
+	// Updates skip their transaction, which would need a connection
+	db := dryRunDB(t).Session(&gorm.Session{SkipDefaultTransaction: true})
+	err := db.Callback().Query().Before("gorm:preload").Register("test:entries", func(tx *gorm.DB) {
+		switch dest := tx.Statement.Dest.(type) {
+		case *Entry:
+			*dest = Entry{ID: 1, UserID: 1, Date: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Visited: true}
+		case *[]Session:
+			*dest = []Session{{ID: 2, EntryID: 1, WorkoutID: ptr[uint](3)}}
+		case *Workout:
+			*dest = Workout{ID: 4, UserID: 1, Name: "Legs"}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Callback().Update().After("gorm:update").Register("test:updates", func(tx *gorm.DB) {
+		if strings.Contains(tx.Statement.SQL.String(), `"workout_id"=`) {
+			*updates = append(*updates, tx.Statement.Vars[0])
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPatchEntryWorkout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantUpdates []any
+	}{
+		{"null clears the workout", `{"workout_id": null}`, http.StatusOK, []any{(*uint)(nil)}},
+		{"a workout replaces it", `{"workout_id": 4}`, http.StatusOK, []any{ptr[uint](4)}},
+		{"omitted leaves it unchanged", `{}`, http.StatusBadRequest, nil},
+		{"not a workout", `{"workout_id": "Legs"}`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates []any
+			r := gin.New()
+			r.PATCH("/entry/:date", func(c *gin.Context) {
+				c.Set("user", &User{ID: 1, Timezone: "UTC"})
+			}, patchEntry(entryDB(t, &updates)))
+
+			req := httptest.NewRequest(http.MethodPatch, "/entry/2024-03-01", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if !slices.EqualFunc(updates, tt.wantUpdates, func(got, want any) bool {
+				g, _ := got.(*uint)
+				w, _ := want.(*uint)
+				return (g == nil) == (w == nil) && (g == nil || *g == *w)
+			}) {
+				t.Errorf("workout_id updates = %v, want %v", updates, tt.wantUpdates)
+			}
+		})
+	}
+}
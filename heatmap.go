@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Heatmap layout in pixels.
+const (
+	heatmapCell   = 11
+	heatmapGap    = 3
+	heatmapLeft   = 30
+	heatmapTop    = 20
+	heatmapMaxAge = 3600
+)
+
+// heatmapTheme is the set of colors a heatmap is drawn with.
+type heatmapTheme struct {
+	Background string
+	Text       string
+	Empty      string
+	Visited    string
+}
+
+var heatmapThemes = map[string]heatmapTheme{
+	"light": {Background: "#ffffff", Text: "#57606a", Empty: "#ebedf0", Visited: "#216e39"},
+	"dark":  {Background: "#0d1117", Text: "#8b949e", Empty: "#161b22", Visited: "#39d353"},
+}
+
+// workoutPalette colors workout types when coloring by workout. Types get
+// colors in order of creation so they stay the same from year to year.
+var workoutPalette = []string{
+	"#2da44e", "#0969da", "#cf222e", "#bf8700", "#8250df", "#1b7c83", "#bc4c00", "#6e7781",
+}
+
+// heatmapDay is what a single cell shows.
+type heatmapDay struct {
+	Visited  bool
+	Workouts []string
+}
+
+func renderHeatmap(year int, days map[string]heatmapDay, theme heatmapTheme, workoutColors map[string]string) string {
+	first := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	next := first.AddDate(1, 0, 0)
+	gridStart := startOfWeek(first)
+
+	// Columns are Monday-based weeks, 53 of them in most years
+	weeks := daysBetween(gridStart, next.AddDate(0, 0, -1))/7 + 1
+	step := heatmapCell + heatmapGap
+	width := heatmapLeft + weeks*step
+	height := heatmapTop + 7*step
+	if workoutColors != nil {
+		height += 20 // room for the legend
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="Gym visits in %d">`, width, height, width, height, year)
+	fmt.Fprintf(&b, `<title>Gym visits in %d</title>`, year)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`, theme.Background)
+	fmt.Fprintf(&b, `<g font-family="-apple-system,BlinkMacSystemFont,Segoe UI,Helvetica,Arial,sans-serif" font-size="9" fill="%s">`, theme.Text)
+
+	// Month labels above the week a month starts in
+	for m := time.January; m <= time.December; m++ {
+		week := daysBetween(gridStart, time.Date(year, m, 1, 0, 0, 0, 0, time.UTC)) / 7
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, heatmapLeft+week*step, heatmapTop-8, m.String()[:3])
+	}
+	for row, label := range []string{"Mon", "", "Wed", "", "Fri"} {
+		if label != "" {
+			fmt.Fprintf(&b, `<text x="0" y="%d">%s</text>`, heatmapTop+row*step+heatmapCell-2, label)
+		}
+	}
+	b.WriteString(`</g>`)
+
+	for d := first; d.Before(next); d = d.AddDate(0, 0, 1) {
+		offset := daysBetween(gridStart, d)
+		x := heatmapLeft + (offset/7)*step
+		y := heatmapTop + (offset%7)*step
+
+		key := d.Format("2006-01-02")
+		day := days[key]
+		fill := theme.Empty
+		label := key + ": no visit"
+		if day.Visited {
+			fill = theme.Visited
+			label = key + ": visited"
+			if len(day.Workouts) > 0 {
+				label = key + ": " + strings.Join(day.Workouts, ", ")
+				if color, ok := workoutColors[day.Workouts[0]]; ok {
+					fill = color
+				}
+			}
+		}
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" rx="2" fill="%s"><title>%s</title></rect>`,
+			x, y, heatmapCell, heatmapCell, fill, html.EscapeString(label))
+	}
+
+	if workoutColors != nil {
+		names := make([]string, 0, len(workoutColors))
+		for name := range workoutColors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		x := heatmapLeft
+		y := heatmapTop + 7*step + 6
+		fmt.Fprintf(&b, `<g font-family="-apple-system,BlinkMacSystemFont,Segoe UI,Helvetica,Arial,sans-serif" font-size="9" fill="%s">`, theme.Text)
+		for _, name := range names {
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" rx="2" fill="%s"/>`, x, y, heatmapCell, heatmapCell, workoutColors[name])
+			fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, x+heatmapCell+4, y+heatmapCell-2, html.EscapeString(name))
+			x += heatmapCell + 4 + 6*len([]rune(name)) + 12
+		}
+		b.WriteString(`</g>`)
+	}
+
+	b.WriteString(`</svg>`)
+	return b.String()
+}
+
+func getHeatmap(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+		year := currentDate(userLocation(user)).Year()
+		if value := c.Query("year"); value != "" {
+			y, err := strconv.Atoi(value)
+			if err != nil || y < 1970 || y > 9999 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid year"})
+				return
+			}
+			year = y
+		}
+
+		theme, ok := heatmapThemes[c.DefaultQuery("theme", "light")]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "theme must be light or dark"})
+			return
+		}
+		// Individual colors override the theme's
+		for _, p := range []struct {
+			name  string
+			color *string
+		}{
+			{"bg", &theme.Background},
+			{"text", &theme.Text},
+			{"empty", &theme.Empty},
+			{"color", &theme.Visited},
+		} {
+			if *p.color, ok = colorParam(c, p.name, *p.color); !ok {
+				return
+			}
+		}
+
+		colorBy := c.DefaultQuery("color_by", "visited")
+		if colorBy != "visited" && colorBy != "workout" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "color_by must be visited or workout"})
+			return
+		}
+
+		first := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		var entries []Entry
+		if err := preloadSessions(db).
+			Where("user_id = ? AND date >= ? AND date < ?", user.ID, first, first.AddDate(1, 0, 0)).
+			Find(&entries).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		days := map[string]heatmapDay{}
+		for _, e := range entries {
+			key := formatDate(e.Date)
+			day := days[key]
+			day.Visited = day.Visited || e.Visited
+			for _, s := range e.Sessions {
+				if s.Workout != nil {
+					day.Workouts = append(day.Workouts, s.Workout.Name)
+				}
+			}
+			days[key] = day
+		}
+
+		var workoutColors map[string]string
+		if colorBy == "workout" {
+			var workouts []Workout
+			if err := db.Where("user_id = ?", user.ID).Order("id ASC").Find(&workouts).Error; err != nil {
+				internalError(c, err)
+				return
+			}
+			used := map[string]bool{}
+			for _, day := range days {
+				if day.Visited && len(day.Workouts) > 0 {
+					used[day.Workouts[0]] = true
+				}
+			}
+			workoutColors = map[string]string{}
+			for i, w := range workouts {
+				if used[w.Name] {
+					workoutColors[w.Name] = workoutPalette[i%len(workoutPalette)]
+				}
+			}
+		}
+
+		writeSVG(c, renderHeatmap(year, days, theme, workoutColors), heatmapMaxAge)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxImportSize caps the request body of an import.
+const maxImportSize = 10 << 20
+
+// errImportRollback aborts the import transaction on a dry run or when any
+// row is invalid.
+var errImportRollback = errors.New("import rolled back")
+
+// Row statuses. Rows that would have been inserted are reported as
+// would_insert when the import isn't committed.
+const (
+	importInserted    = "inserted"
+	importWouldInsert = "would_insert"
+	importSkipped     = "skipped"
+	importInvalid     = "invalid"
+)
+
+type importRow struct {
+	Line    int    `json:"line"`
+	Date    string `json:"date"`
+	Workout string `json:"workout,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+
+	// date is the parsed Date of rows to insert
+	date time.Time
+}
+
+// parseImportCSV reads rows from CSV with a header naming at least a date
+// column and optionally a workout column. Files produced by GET /export are
+// accepted too, only their visit rows are imported.
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("missing CSV header")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	dateCol, ok := columns["date"]
+	if !ok {
+		return nil, errors.New("CSV header must contain a date column")
+	}
+	workoutCol, hasWorkout := columns["workout"]
+	typeCol, hasType := columns["type"]
+
+	field := func(record []string, i int) string {
+		if i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hasType && field(record, typeCol) != "visit" {
+			continue
+		}
+		row := importRow{Line: line, Date: field(record, dateCol)}
+		if hasWorkout {
+			row.Workout = field(record, workoutCol)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseImportJSON reads rows from a JSON array of {"date", "workout"}
+// objects. Lines are the 1-based positions in the array.
+func parseImportJSON(r io.Reader) ([]importRow, error) {
+	var items []struct {
+		Date    string `json:"date"`
+		Workout string `json:"workout"`
+	}
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, errors.New("invalid JSON, expected an array of {\"date\", \"workout\"} objects")
+	}
+
+	rows := make([]importRow, 0, len(items))
+	for i, item := range items {
+		rows = append(rows, importRow{
+			Line:    i + 1,
+			Date:    strings.TrimSpace(item.Date),
+			Workout: strings.TrimSpace(item.Workout),
+		})
+	}
+	return rows, nil
+}
+
+// checkImportRows validates rows and marks those that can't be inserted as
+// invalid or skipped, leaving the status of the rest empty. existing holds
+// the days that already have an entry and workouts the user's workout
+// types by lowercase name. Archived types are rejected like POST /entry
+// does. Rows on the same day are one entry, as exports
+// have a visit row per session, so later rows of a day are kept when they
+// add a workout. It reports whether every row was valid.
+func checkImportRows(rows []importRow, existing map[string]bool, workouts map[string]Workout, createWorkouts bool) bool {
+	imported := map[string]bool{}
+
+	valid := true
+	for i := range rows {
+		row := &rows[i]
+
+		date, err := parseDate(row.Date)
+		if err != nil {
+			row.Status, row.Message = importInvalid, "invalid date format, use YYYY-MM-DD"
+			valid = false
+			continue
+		}
+		day := date.Format("2006-01-02")
+
+		workout, known := workouts[strings.ToLower(row.Workout)]
+		if row.Workout != "" && !known && !createWorkouts {
+			row.Status, row.Message = importInvalid, "workout not found"
+			valid = false
+			continue
+		}
+		if known && workout.Archived {
+			row.Status, row.Message = importInvalid, "workout is archived"
+			valid = false
+			continue
+		}
+
+		if existing[day] {
+			row.Status, row.Message = importSkipped, "entry already exists"
+			continue
+		}
+		if imported[day] && row.Workout == "" {
+			row.Status, row.Message = importSkipped, "duplicate date in import"
+			continue
+		}
+		imported[day] = true
+		row.date = date
+	}
+
+	return valid
+}
+
+// importRows validates and inserts rows within tx, filling in each row's
+// status. It reports whether every row was valid.
+func importRows(tx *gorm.DB, user *User, rows []importRow, createWorkouts bool) (bool, error) {
+	// Map workout names to the user's workout types, ignoring case
+	var userWorkouts []Workout
+	if err := tx.Where("user_id = ?", user.ID).Find(&userWorkouts).Error; err != nil {
+		return false, err
+	}
+	workouts := map[string]Workout{}
+	for _, w := range userWorkouts {
+		workouts[strings.ToLower(w.Name)] = w
+	}
+
+	// Days that already have an entry are skipped like POST /entry does
+	var dates []time.Time
+	if err := tx.Model(&Entry{}).Where("user_id = ?", user.ID).Pluck("date", &dates).Error; err != nil {
+		return false, err
+	}
+	existing := map[string]bool{}
+	for _, d := range dates {
+		existing[formatDate(d)] = true
+	}
+
+	valid := checkImportRows(rows, existing, workouts, createWorkouts)
+	entryIDs := map[string]uint{}
+	for i := range rows {
+		row := &rows[i]
+		if row.Status != "" {
+			continue
+		}
+
+		// Later rows of a day add a session to the entry of its first row
+		day := formatDate(row.date)
+		entryID, added := entryIDs[day]
+		if added {
+			row.Message = "session added"
+		} else {
+			// A concurrent request may have logged the day since it was checked
+			entry := Entry{UserID: user.ID, Date: row.date, Visited: true}
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry)
+			if result.Error != nil {
+				return false, result.Error
+			}
+			if result.RowsAffected == 0 {
+				row.Status, row.Message = importSkipped, "entry already exists"
+				continue
+			}
+			entryID = entry.ID
+			entryIDs[day] = entryID
+		}
+
+		// Workouts are only created for rows that are inserted
+		if row.Workout != "" {
+			workoutName := strings.ToLower(row.Workout)
+			workout, known := workouts[workoutName]
+			if !known {
+				created, err := findOrCreateWorkout(tx, user.ID, row.Workout)
+				if err != nil {
+					return false, err
+				}
+				workout = *created
+				workouts[workoutName] = workout
+			}
+			if err := tx.Create(&Session{EntryID: entryID, WorkoutID: &workout.ID}).Error; err != nil {
+				return false, err
+			}
+		}
+		row.Status = importInserted
+	}
+
+	return valid, nil
+}
+
+// summarizeImport counts the rows by status. When the import wasn't
+// committed, rows are relabelled as would_insert since nothing was saved.
+func summarizeImport(rows []importRow, committed bool) map[string]int {
+	inserted := importInserted
+	if !committed {
+		inserted = importWouldInsert
+	}
+
+	summary := map[string]int{inserted: 0, importSkipped: 0, importInvalid: 0}
+	for i := range rows {
+		if rows[i].Status == importInserted {
+			rows[i].Status = inserted
+		}
+		summary[rows[i].Status]++
+	}
+	return summary
+}
+
+func postImport(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		dryRun := c.Query("dry_run") == "true"
+		createWorkouts := c.Query("create_workouts") == "true"
+
+		// The format comes from ?format= or else the Content-Type
+		format := c.Query("format")
+		if format == "" {
+			if strings.Contains(c.ContentType(), "csv") {
+				format = "csv"
+			} else {
+				format = "json"
+			}
+		}
+
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+		var rows []importRow
+		var err error
+		switch format {
+		case "csv":
+			rows, err = parseImportCSV(body)
+		case "json":
+			rows, err = parseImportJSON(body)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(rows) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no rows to import"})
+			return
+		}
+
+		// Everything is imported in one transaction, which is rolled back on
+		// a dry run or if any row is invalid
+		valid := false
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			valid, err = importRows(tx, user, rows, createWorkouts)
+			if err != nil {
+				return err
+			}
+			if dryRun || !valid {
+				return errImportRollback
+			}
+			return nil
+		})
+		if err != nil && err != errImportRollback {
+			internalError(c, err)
+			return
+		}
+
+		committed := valid && !dryRun
+		summary := summarizeImport(rows, committed)
+
+		status := http.StatusOK
+		if !valid {
+			status = http.StatusUnprocessableEntity
+		}
+		c.JSON(status, gin.H{
+			"dry_run":   dryRun,
+			"committed": committed,
+			"summary":   summary,
+			"rows":      rows,
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []importRow
+		wantErr bool
+	}{
+		{
+			name: "date and workout",
+			csv:  "date,workout\n2024-03-01,Legs\n2024-03-02,\n",
+			want: []importRow{
+				{Line: 2, Date: "2024-03-01", Workout: "Legs"},
+				{Line: 3, Date: "2024-03-02"},
+			},
+		},
+		{
+			name: "header in any case and order, padded",
+			csv:  "Workout, DATE\n Push , 2024-03-01\n",
+			want: []importRow{{Line: 2, Date: "2024-03-01", Workout: "Push"}},
+		},
+		{
+			name: "dates only, short rows",
+			csv:  "date,notes\n2024-03-01\n",
+			want: []importRow{{Line: 2, Date: "2024-03-01"}},
+		},
+		{
+			name: "export file keeps visit rows",
+			csv:  "type,date,workout,exercise\nvisit,2024-03-01,Legs,\nset,2024-03-01,,Squat\nvisit,2024-03-03,,\n",
+			want: []importRow{
+				{Line: 2, Date: "2024-03-01", Workout: "Legs"},
+				{Line: 4, Date: "2024-03-03"},
+			},
+		},
+		{name: "no date column", csv: "day,workout\n2024-03-01,Legs\n", wantErr: true},
+		{name: "empty", csv: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseImportCSV(strings.NewReader(tt.csv))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseImportJSON(t *testing.T) {
+	got, err := parseImportJSON(strings.NewReader(`[{"date": " 2024-03-01 ", "workout": "Legs"}, {"date": "2024-03-02"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []importRow{
+		{Line: 1, Date: "2024-03-01", Workout: "Legs"},
+		{Line: 2, Date: "2024-03-02"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %+v, want %+v", got, want)
+	}
+
+	for _, invalid := range []string{`{"date": "2024-03-01"}`, `[{"date": 20240301}]`, `not json`} {
+		if _, err := parseImportJSON(strings.NewReader(invalid)); err == nil {
+			t.Errorf("parsing %s: expected an error", invalid)
+		}
+	}
+}
+
+func TestCheckImportRows(t *testing.T) {
+	existing := map[string]bool{"2024-03-01": true}
+	workouts := map[string]Workout{"legs": {ID: 1, Name: "Legs"}, "swim": {ID: 2, Name: "Swim", Archived: true}}
+
+	newRows := func() []importRow {
+		return []importRow{
+			{Line: 1, Date: "2024-03-01"},
+			{Line: 2, Date: "2024-03-02", Workout: "LEGS"},
+			{Line: 3, Date: "2024-03-02"},
+			{Line: 4, Date: "03/04/2024"},
+			{Line: 5, Date: "2024-02-30"},
+			{Line: 6, Date: "2024-03-05", Workout: "Yoga"},
+			{Line: 7, Date: "2024-03-06"},
+			// A second session on a day, as exports have
+			{Line: 8, Date: "2024-03-02", Workout: "legs"},
+			{Line: 9, Date: "2024-03-07", Workout: "Swim"},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		createWorkouts bool
+		wantValid      bool
+		wantStatus     []string
+	}{
+		{"unknown workouts are invalid", false, false, []string{
+			importSkipped, "", importSkipped, importInvalid, importInvalid, importInvalid, "", "", importInvalid,
+		}},
+		{"unknown workouts are created", true, false, []string{
+			importSkipped, "", importSkipped, importInvalid, importInvalid, "", "", "", importInvalid,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := newRows()
+			if valid := checkImportRows(rows, existing, workouts, tt.createWorkouts); valid != tt.wantValid {
+				t.Errorf("valid = %v, want %v", valid, tt.wantValid)
+			}
+			for i, row := range rows {
+				if row.Status != tt.wantStatus[i] {
+					t.Errorf("line %d status = %q (%s), want %q", row.Line, row.Status, row.Message, tt.wantStatus[i])
+				}
+			}
+		})
+	}
+
+	// Skipped rows say why
+	rows := newRows()
+	checkImportRows(rows, existing, workouts, false)
+	if rows[0].Message != "entry already exists" || rows[2].Message != "duplicate date in import" {
+		t.Errorf("messages = %q, %q", rows[0].Message, rows[2].Message)
+	}
+	if rows[8].Message != "workout is archived" {
+		t.Errorf("archived workout message = %q", rows[8].Message)
+	}
+	if got := formatDate(rows[1].date); got != "2024-03-02" {
+		t.Errorf("parsed date = %s, want 2024-03-02", got)
+	}
+}
+
+func TestSummarizeImport(t *testing.T) {
+	rows := func() []importRow {
+		return []importRow{
+			{Line: 1, Status: importInserted},
+			{Line: 2, Status: importInserted},
+			{Line: 3, Status: importSkipped},
+		}
+	}
+
+	committed := rows()
+	want := map[string]int{importInserted: 2, importSkipped: 1, importInvalid: 0}
+	if got := summarizeImport(committed, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("committed summary = %v, want %v", got, want)
+	}
+	if committed[0].Status != importInserted {
+		t.Errorf("committed row status = %q, want inserted", committed[0].Status)
+	}
+
+	// A dry run or rolled back import saved nothing
+	rolledBack := rows()
+	want = map[string]int{importWouldInsert: 2, importSkipped: 1, importInvalid: 0}
+	if got := summarizeImport(rolledBack, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("rolled back summary = %v, want %v", got, want)
+	}
+	for _, row := range rolledBack[:2] {
+		if row.Status != importWouldInsert {
+			t.Errorf("line %d status = %q, want would_insert", row.Line, row.Status)
+		}
+	}
+}
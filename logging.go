@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validRequestID limits the request IDs accepted from clients to something
+// that's safe to echo back and log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// logLevel is the minimum level logged, set from the config's log_level.
+var logLevel slog.LevelVar
+
+// setupLogging makes slog write JSON to stdout at logLevel. It becomes the
+// default logger, so output of the log package ends up as JSON too.
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel})))
+
+	// gin's startup messages, like the route list, are debug output
+	gin.DebugPrintFunc = func(format string, values ...any) {
+		slog.Debug(strings.TrimSpace(fmt.Sprintf(format, values...)))
+	}
+}
+
+// fatal logs err, if any, and exits, for failures during startup.
+func fatal(msg string, err error) {
+	if err != nil {
+		slog.Error(msg, "error", err)
+	} else {
+		slog.Error(msg)
+	}
+	os.Exit(1)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns the logger for the current request, which tags
+// every line with the request and trace IDs.
+func requestLogger(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get("logger"); ok {
+		return logger.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+// internalError responds with a 500 and records err so the request log
+// includes it. The error itself stays out of the response, it can name
+// tables and constraints, but the request ID lets users report it.
+func internalError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+		"error":      "internal server error",
+		"request_id": c.GetString("request_id"),
+	})
+}
+
+// requestLogging assigns every request an ID, taken from X-Request-ID when
+// the caller sends a usable one, and logs a line for it once it's done.
+// Panics are recovered and logged with their stack.
+func requestLogging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Header("X-Request-ID", id)
+		c.Set("request_id", id)
+
+		logger := slog.Default().With("request_id", id)
+		if traceID := c.GetString("trace_id"); traceID != "" {
+			logger = logger.With("trace_id", traceID)
+		}
+		c.Set("logger", logger)
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					if r == http.ErrAbortHandler {
+						panic(r)
+					}
+					logger.Error("panic", "panic", r, "stack", string(debug.Stack()))
+					c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+						"error":      "internal server error",
+						"request_id": id,
+					})
+				}
+			}()
+			c.Next()
+		}()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+		attrs := []any{
+			"method", c.Request.Method,
+			"route", route,
+			"path", c.Request.URL.Path,
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		}
+		if value, ok := c.Get("user"); ok {
+			user := value.(*User)
+			attrs = append(attrs, "user_id", user.ID, "user", user.Name)
+		} else if c.GetBool("admin") {
+			attrs = append(attrs, "user", "admin")
+		}
+		if value, ok := c.Get("api_key"); ok {
+			attrs = append(attrs, "api_key_id", value.(*APIKey).ID)
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "error", strings.Join(c.Errors.Errors(), "; "))
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		logger.Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
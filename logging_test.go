@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestInternalErrorHidesTheError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/entry", nil)
+	c.Set("request_id", "req-1")
+
+	err := errors.New(`ERROR: duplicate key value violates unique constraint "idx_entry_user_date"`)
+	internalError(c, err)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"error": "internal server error", "request_id": "req-1"}
+	if len(body) != len(want) || body["error"] != want["error"] || body["request_id"] != want["request_id"] {
+		t.Errorf("body = %v, want %v", body, want)
+	}
+	// The error is kept for the request log
+	if len(c.Errors) != 1 || c.Errors[0].Err != err {
+		t.Errorf("errors = %v, want the error recorded", c.Errors)
+	}
+}
@@ -1,120 +1,206 @@
 package main
 
 import (
-	"log"
-	"os"
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	// Timezones work without tzdata in the image
+	_ "time/tzdata"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 func main() {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		log.Fatal("DATABASE_URL not set")
+	setupLogging()
+
+	// Settings come from CONFIG_FILE and the environment, see config.go
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", err)
 	}
+	setConfig(cfg)
 
-	db, err := gorm.Open(postgres.Open(dbURL), &gorm.Config{})
+	// Bearer tokens are accepted alongside API keys when OIDC is configured
+	bearerVerifier = newOIDCVerifier(cfg.OIDC)
+
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Errors are translated so unique violations can be told apart
+	db, err := gorm.Open(postgres.Open(cfg.Database.URL), &gorm.Config{TranslateError: true})
+	if err != nil {
+		fatal("Failed to connect to database", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		fatal("Failed to connect to database", err)
+	}
+	sqlDB.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(cfg.Database.ConnMaxIdleTime)
+
+	// Merge duplicate days and names, which the unique indexes added by the
+	// migration would refuse
+	if err := mergeDuplicates(db); err != nil {
+		fatal("Failed to merge duplicates", err)
 	}
 
 	// Auto-migrate the schema
-	if err := db.AutoMigrate(&Workout{}, &Entry{}, &Goal{}, &Milestone{}); err != nil {
-		log.Fatal("Failed to migrate database:", err)
-	}
-
-	// Ensure goal exists
-	var goal Goal
-	if err := db.First(&goal).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			// Create default goal
-			defaultGoal := Goal{Value: 100}
-			if err := db.Create(&defaultGoal).Error; err != nil {
-				log.Fatal("Failed to create default goal:", err)
-			}
-			goal = defaultGoal
-		} else {
-			log.Fatal("Failed to check goal:", err)
-		}
+	if err := db.AutoMigrate(&User{}, &APIKey{}, &Workout{}, &Entry{}, &Session{}, &Goal{}, &WeeklyGoal{}, &Milestone{}, &Exercise{}, &SetLog{}, &PersonalRecord{}); err != nil {
+		fatal("Failed to migrate database", err)
 	}
 
-	// Seed milestones if none exist
-	var milestoneCount int64
-	db.Model(&Milestone{}).Count(&milestoneCount)
-	if milestoneCount == 0 {
-		milestones := []Milestone{
-			{GoalID: goal.ID, Target: 15, Name: "Getting Started"},
-			{GoalID: goal.ID, Target: 30, Name: "Building Habits"},
-			{GoalID: goal.ID, Target: 50, Name: "Halfway Hero"},
-			{GoalID: goal.ID, Target: 75, Name: "On Fire"},
-			{GoalID: goal.ID, Target: 100, Name: "Goal Crusher"},
-		}
-		if err := db.Create(&milestones).Error; err != nil {
-			log.Fatal("Failed to seed milestones:", err)
-		}
+	// Move the per-entry workout into sessions
+	if err := migrateEntryWorkouts(db); err != nil {
+		fatal("Failed to migrate entry workouts", err)
 	}
 
-	// Seed workouts if none exist
-	var workoutCount int64
-	db.Model(&Workout{}).Count(&workoutCount)
-	if workoutCount == 0 {
-		workouts := []Workout{
-			{Name: "Push"},
-			{Name: "Pull"},
-			{Name: "Legs"},
-			{Name: "Cardio"},
-		}
-		if err := db.Create(&workouts).Error; err != nil {
-			log.Fatal("Failed to seed workouts:", err)
-		}
+	// Hash the plaintext keys users used to have
+	if err := migrateUserAPIKeys(db); err != nil {
+		fatal("Failed to migrate API keys", err)
 	}
 
-	r := gin.Default()
-
-	// Enable CORS for localhost and gym.senthil.nz
-	r.Use(cors.New(cors.Config{
-		AllowOriginFunc: func(origin string) bool {
-			// Allow localhost
-			if origin == "http://localhost" || origin == "https://localhost" {
-				return true
-			}
-			// Allow localhost with ports
-			if len(origin) > 17 && origin[:17] == "http://localhost:" {
-				return true
-			}
-			if len(origin) > 18 && origin[:18] == "https://localhost:" {
-				return true
-			}
-			// Allow gym.senthil.nz
-			if origin == "http://gym.senthil.nz" || origin == "https://gym.senthil.nz" {
-				return true
-			}
-			return false
-		},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "X-API-Key"},
-		AllowCredentials: true,
-	}))
-
-	r.GET("/entry", getEntries(db))
-	r.POST("/entry", postEntry(db))
-	r.PUT("/entry/workout", updateEntryWorkout(db))
-	r.GET("/health", healthHandler(db))
-	r.GET("/visits/progress/message", getProgressMessage(db))
-	r.GET("/visits/streak", getStreak(db))
-	r.GET("/visits/stats", getStats(db))
-	r.GET("/visits/weekly", getWeeklyStats(db))
-	r.GET("/visits/milestone", getMilestoneProgress(db))
-	r.GET("/visits/forecast", getForecast(db))
-	r.GET("/visits/ai-stats", getAIStats(db))
+	// Hash the plaintext feed tokens users used to have
+	if err := migrateFeedTokens(db); err != nil {
+		fatal("Failed to migrate feed tokens", err)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Assign data from before multi-user support to a default user
+	if err := migrateLegacyData(db); err != nil {
+		fatal("Failed to migrate legacy data", err)
 	}
 
-	r.Run(":" + port)
+	// Retire the previous API_KEY if it was rotated
+	if err := syncDeploymentKeys(db); err != nil {
+		fatal("Failed to update the deployment API key", err)
+	}
+
+	// Time database queries for /metrics
+	if err := registerMetrics(db); err != nil {
+		fatal("Failed to register metrics", err)
+	}
+	if err := registerDBTracing(db); err != nil {
+		fatal("Failed to register tracing", err)
+	}
+
+	limits, err := newRateLimiter(db, cfg.RateLimits.Store)
+	if err != nil {
+		fatal("Invalid rate limits", err)
+	}
+
+	r := gin.New()
+
+	// Client IPs are taken from X-Forwarded-For only when sent by these
+	// proxies. gin trusts every peer by default, which would let clients
+	// pick their own IP and dodge the rate limits.
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		fatal("Invalid server.trusted_proxies", err)
+	}
+
+	r.Use(tracingMiddleware(), traceIDMiddleware(), requestLogging())
+	r.Use(metricsMiddleware())
+	r.Use(corsMiddleware())
+
+	// After CORS, so browsers can read the 429s
+	r.Use(limits.limitRequests())
+
+	r.GET("/health", healthHandler(db))
+	r.GET("/metrics", metricsHandler())
+
+	// User and key management needs API_KEY or a key with the admin scope
+	admin := r.Group("/users", requireAdmin(db))
+	admin.POST("", createUser(db))
+	admin.PATCH("/:id", updateUser(db))
+	admin.GET("/:id/keys", getAPIKeys(db))
+	admin.POST("/:id/keys", postAPIKey(db))
+	admin.DELETE("/:id/keys/:key", revokeAPIKey(db))
+
+	// Feeds are subscribed to by URL, so they take a token instead of a header
+	r.GET("/calendar.ics", requireURLToken(db, feedToken), getCalendar(db))
+	r.GET("/visits/heatmap.svg", requireURLToken(db, feedToken), getHeatmap(db))
+
+	// Badges are published, so they take their own token that unlocks
+	// nothing else
+	badges := r.Group("/badges", requireURLToken(db, badgeToken))
+	badges.GET("/streak.svg", getStreakBadge(db))
+	badges.GET("/progress.svg", getProgressBadge(db))
+	badges.GET("/milestone.svg", getMilestoneBadge(db))
+
+	// Everything below is scoped to the user owning the API key
+	api := r.Group("/", requireUser(db), limits.limitWrites())
+	api.GET("/me", getMe())
+	api.PUT("/me", updateMe(db))
+	api.POST("/me/feed-token", rotateFeedToken(db))
+	api.DELETE("/me/feed-token", revokeURLToken(db, feedToken))
+	api.POST("/me/badge-token", rotateBadgeToken(db))
+	api.DELETE("/me/badge-token", revokeURLToken(db, badgeToken))
+	api.GET("/entry", getEntries(db))
+	api.POST("/entry", postEntry(db))
+	api.PUT("/entry/workout", updateEntryWorkout(db))
+	api.PATCH("/entry/:date", patchEntry(db))
+	api.GET("/entry/:date/sessions", getSessions(db))
+	api.POST("/entry/:date/sessions", postSession(db))
+	api.PUT("/entry/:date/sessions/:id", updateSession(db))
+	api.DELETE("/entry/:date/sessions/:id", deleteSession(db))
+	api.DELETE("/entry/:date", deleteEntry(db))
+	api.GET("/entry/:date/sets", getSets(db))
+	api.POST("/entry/:date/sets", postSet(db))
+	api.PUT("/entry/:date/sets/:id", updateSet(db))
+	api.DELETE("/entry/:date/sets/:id", deleteSet(db))
+	api.GET("/workouts", getWorkouts(db))
+	api.POST("/workouts", postWorkout(db))
+	api.PUT("/workouts/:id", updateWorkout(db))
+	api.DELETE("/workouts/:id", archiveWorkout(db))
+	api.GET("/exercises", getExercises(db))
+	api.POST("/exercises", postExercise(db))
+	api.GET("/goals", getGoals(db))
+	api.POST("/goals", postGoal(db))
+	api.GET("/goals/:id", getGoal(db))
+	api.PUT("/goals/:id", updateGoal(db))
+	api.DELETE("/goals/:id", deleteGoal(db))
+	api.GET("/goals/:id/milestones", getMilestones(db))
+	api.POST("/goals/:id/milestones", postMilestone(db))
+	api.PUT("/goals/:id/milestones/:milestone", updateMilestone(db))
+	api.DELETE("/goals/:id/milestones/:milestone", deleteMilestone(db))
+	api.GET("/goal/weekly", getWeeklyGoal(db))
+	api.PUT("/goal/weekly", putWeeklyGoal(db))
+	api.GET("/visits/progress/message", getProgressMessage(db))
+	api.GET("/visits/streak", getStreak(db))
+	api.GET("/visits/stats", getStats(db))
+	api.GET("/visits/weekly", getWeeklyStats(db))
+	api.GET("/visits/milestone", getMilestoneProgress(db))
+	api.GET("/visits/forecast", getForecast(db))
+	api.GET("/visits/ai-stats", limits.limitAI(), getAIStats(db))
+	api.GET("/export", getExport(db))
+	api.POST("/import", postImport(db))
+	api.POST("/activities", postActivity(db))
+	api.GET("/records", getRecords(db))
+	api.GET("/records/:exercise/history", getRecordHistory(db))
+
+	// Everything but the structural settings can change without a restart
+	go reloadOnSIGHUP(func() {
+		if err := syncDeploymentKeys(db); err != nil {
+			slog.Error("failed to update the deployment API key", "error", err)
+		}
+	})
+
+	server := &http.Server{
+		Addr:              ":" + strconv.Itoa(cfg.Server.Port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		fatal("Server stopped", err)
+	}
 }
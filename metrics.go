@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gym_http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gym_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gym_db_query_duration_seconds",
+		Help:    "Database query latency by operation and table.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+
+	dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gym_db_query_errors_total",
+		Help: "Failed database queries by operation and table, not counting missing records.",
+	}, []string{"operation", "table"})
+
+	ollamaDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "gym_ollama_request_duration_seconds",
+		Help: "Latency of Ollama generate calls, including failed ones.",
+		// Generations take seconds to minutes
+		Buckets: []float64{.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	})
+
+	ollamaRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gym_ollama_requests_total",
+		Help: "Ollama generate calls by result, success or error.",
+	}, []string{"result"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gym_rate_limited_total",
+		Help: "Requests rejected with 429 by limit: ip, auth, writes or ai.",
+	}, []string{"limit"})
+)
+
+// metricsMiddleware records the count and latency of every request under
+// its route pattern, so /entry/2024-03-01 and /entry/2024-03-02 share one
+// series.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// aroundGorm registers before and after callbacks around each of GORM's
+// built-in operations, named <prefix>:before_<operation> and so on.
+func aroundGorm(db *gorm.DB, prefix string, before func(*gorm.DB), after func(operation string) func(*gorm.DB)) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register(prefix+":before_create", before),
+		cb.Create().After("gorm:create").Register(prefix+":after_create", after("create")),
+		cb.Query().Before("gorm:query").Register(prefix+":before_query", before),
+		cb.Query().After("gorm:query").Register(prefix+":after_query", after("query")),
+		cb.Update().Before("gorm:update").Register(prefix+":before_update", before),
+		cb.Update().After("gorm:update").Register(prefix+":after_update", after("update")),
+		cb.Delete().Before("gorm:delete").Register(prefix+":before_delete", before),
+		cb.Delete().After("gorm:delete").Register(prefix+":after_delete", after("delete")),
+		cb.Row().Before("gorm:row").Register(prefix+":before_row", before),
+		cb.Row().After("gorm:row").Register(prefix+":after_row", after("row")),
+		cb.Raw().Before("gorm:raw").Register(prefix+":before_raw", before),
+		cb.Raw().After("gorm:raw").Register(prefix+":after_raw", after("raw")),
+	)
+}
+
+// gormTable names the table a statement ran against for labels.
+func gormTable(db *gorm.DB) string {
+	if db.Statement.Table == "" {
+		return "unknown"
+	}
+	return db.Statement.Table
+}
+
+// registerDBMetrics times every GORM operation.
+func registerDBMetrics(db *gorm.DB) error {
+	const startKey = "metrics:start"
+
+	before := func(db *gorm.DB) {
+		db.InstanceSet(startKey, time.Now())
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			value, ok := db.InstanceGet(startKey)
+			if !ok {
+				return
+			}
+			table := gormTable(db)
+			dbQueryDuration.WithLabelValues(operation, table).Observe(time.Since(value.(time.Time)).Seconds())
+			if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+				dbQueryErrors.WithLabelValues(operation, table).Inc()
+			}
+		}
+	}
+
+	return aroundGorm(db, "metrics", before, after)
+}
+
+// observeOllama records the outcome of an Ollama call that began at start.
+func observeOllama(start time.Time, err error) {
+	ollamaDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		ollamaRequests.WithLabelValues("error").Inc()
+	} else {
+		ollamaRequests.WithLabelValues("success").Inc()
+	}
+}
+
+// trainingCollector reports per-user training gauges, computed from the
+// database whenever Prometheus scrapes. A scrape runs a fixed number of
+// aggregate queries however many users and entries there are.
+type trainingCollector struct {
+	db *gorm.DB
+
+	visits       *prometheus.Desc
+	streak       *prometheus.Desc
+	goalVisits   *prometheus.Desc
+	goalTarget   *prometheus.Desc
+	goalProgress *prometheus.Desc
+}
+
+func newTrainingCollector(db *gorm.DB) *trainingCollector {
+	labels := []string{"user"}
+	return &trainingCollector{
+		db:           db,
+		visits:       prometheus.NewDesc("gym_visits", "Total visited days.", labels, nil),
+		streak:       prometheus.NewDesc("gym_current_streak_days", "Current streak of consecutive visit days, 0 once broken.", labels, nil),
+		goalVisits:   prometheus.NewDesc("gym_goal_visits", "Visits counting towards the active goal.", labels, nil),
+		goalTarget:   prometheus.NewDesc("gym_goal_target", "Visits the active goal is aiming for.", labels, nil),
+		goalProgress: prometheus.NewDesc("gym_goal_progress_ratio", "Progress towards the active goal, 1 when achieved.", labels, nil),
+	}
+}
+
+func (t *trainingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.visits
+	ch <- t.streak
+	ch <- t.goalVisits
+	ch <- t.goalTarget
+	ch <- t.goalProgress
+}
+
+// lastRun is the most recent run of consecutive visit days of a user.
+type lastRun struct {
+	UserID uint
+	Last   time.Time
+	Days   int
+}
+
+// lastRuns finds each user's most recent run of consecutive visit days.
+// Days of a run minus their position in it give the same date, which
+// groups them.
+func lastRuns(db *gorm.DB) (map[uint]lastRun, error) {
+	var rows []lastRun
+	err := db.Raw(`
+		SELECT DISTINCT ON (user_id) user_id, MAX(day) AS last, COUNT(*) AS days
+		FROM (
+			SELECT user_id, day, day - (ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY day))::int AS run
+			FROM (SELECT DISTINCT user_id, (date AT TIME ZONE 'UTC')::date AS day FROM entries WHERE visited) AS days
+		) AS numbered
+		GROUP BY user_id, run
+		ORDER BY user_id, last DESC`).Scan(&rows).Error
+	runs := map[uint]lastRun{}
+	for _, row := range rows {
+		runs[row.UserID] = row
+	}
+	return runs, err
+}
+
+// countsBy counts the rows of query grouped by key.
+func countsBy(query *gorm.DB, key string) (map[uint]int64, error) {
+	var rows []struct {
+		ID    uint
+		Count int64
+	}
+	err := query.Select(key + " AS id, COUNT(*) AS count").Group(key).Scan(&rows).Error
+	counts := map[uint]int64{}
+	for _, row := range rows {
+		counts[row.ID] = row.Count
+	}
+	return counts, err
+}
+
+func (t *trainingCollector) Collect(ch chan<- prometheus.Metric) {
+	fail := func(err error) {
+		ch <- prometheus.NewInvalidMetric(t.visits, err)
+	}
+
+	var users []User
+	if err := t.db.Find(&users).Error; err != nil {
+		fail(err)
+		return
+	}
+	visits, err := countsBy(t.db.Model(&Entry{}).Where("visited = ?", true), "user_id")
+	if err != nil {
+		fail(err)
+		return
+	}
+	runs, err := lastRuns(t.db)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// Goals are ordered like activeGoal picks them
+	var goals []Goal
+	if err := t.db.Where("archived = ?", false).Order("start_date DESC NULLS LAST, id DESC").Find(&goals).Error; err != nil {
+		fail(err)
+		return
+	}
+	goalCounts, err := countsBy(t.db.Table("goals").
+		Joins("JOIN entries ON entries.user_id = goals.user_id AND entries.visited").
+		Where("goals.archived = ?", false).
+		Where("(goals.start_date IS NULL OR entries.date >= goals.start_date)").
+		Where("(goals.end_date IS NULL OR entries.date <= goals.end_date)"), "goals.id")
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	for i := range users {
+		user := &users[i]
+		today := currentDate(userLocation(user))
+		ch <- prometheus.MustNewConstMetric(t.visits, prometheus.GaugeValue, float64(visits[user.ID]), user.Name)
+
+		streak := 0
+		if run, ok := runs[user.ID]; ok && daysBetween(run.Last, today) <= 1 {
+			streak = run.Days
+		}
+		ch <- prometheus.MustNewConstMetric(t.streak, prometheus.GaugeValue, float64(streak), user.Name)
+
+		// Without an active goal every visit counts towards the default one
+		target, count := currentConfig().Goals.Visits, visits[user.ID]
+		for _, goal := range goals {
+			if goal.UserID != user.ID ||
+				(goal.StartDate != nil && goal.StartDate.After(today)) ||
+				(goal.EndDate != nil && goal.EndDate.Before(today)) {
+				continue
+			}
+			target, count = goal.Value, goalCounts[goal.ID]
+			break
+		}
+		ch <- prometheus.MustNewConstMetric(t.goalVisits, prometheus.GaugeValue, float64(count), user.Name)
+		ch <- prometheus.MustNewConstMetric(t.goalTarget, prometheus.GaugeValue, float64(target), user.Name)
+		if target > 0 {
+			ch <- prometheus.MustNewConstMetric(t.goalProgress, prometheus.GaugeValue, float64(count)/float64(target), user.Name)
+		}
+	}
+}
+
+// trainingRegistry holds the training gauges, which name users and so are
+// only served to scrapes presenting the metrics token.
+var trainingRegistry = prometheus.NewRegistry()
+
+// registerMetrics registers the service's metrics with the default
+// Prometheus registry, which already has the Go runtime and process ones,
+// and the training gauges with trainingRegistry.
+func registerMetrics(db *gorm.DB) error {
+	if err := registerDBMetrics(db); err != nil {
+		return err
+	}
+	for _, c := range []prometheus.Collector{
+		httpRequests, httpDuration, dbQueryDuration, dbQueryErrors,
+		ollamaDuration, ollamaRequests, rateLimited,
+	} {
+		if err := prometheus.Register(c); err != nil {
+			return err
+		}
+	}
+	return trainingRegistry.Register(newTrainingCollector(db))
+}
+
+// metricsHandler serves the Prometheus exposition format. Without a metrics
+// token only operational metrics are served. With one, scrapes must present
+// it as a bearer token and get the training gauges too.
+func metricsHandler() gin.HandlerFunc {
+	operational := promhttp.Handler()
+	all := promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, trainingRegistry}, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		token := currentConfig().Metrics.Token
+		if token == "" {
+			operational.ServeHTTP(c.Writer, c.Request)
+			return
+		}
+		given := c.GetHeader("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			unauthorized(c, "unauthorized")
+			return
+		}
+		all.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// milestonePayload is the request body for creating or replacing a milestone.
+type milestonePayload struct {
+	Name   string `json:"name"`
+	Target int    `json:"target"`
+}
+
+// validateMilestone checks a milestone target against its goal and the
+// goal's other milestones, returning a user-facing message when it is
+// invalid. excludeID skips the milestone being replaced.
+func validateMilestone(db *gorm.DB, goal *Goal, payload *milestonePayload, excludeID uint) (string, error) {
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		return "name is required", nil
+	}
+	if payload.Target <= 0 {
+		return "target must be positive", nil
+	}
+	if payload.Target > goal.Value {
+		return fmt.Sprintf("target must not exceed the goal of %d", goal.Value), nil
+	}
+
+	var count int64
+	if err := db.Model(&Milestone{}).Where("goal_id = ? AND target = ? AND id <> ?", goal.ID, payload.Target, excludeID).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "a milestone with this target already exists", nil
+	}
+
+	return "", nil
+}
+
+// milestoneForID loads the milestone identified by the :milestone path
+// parameter within goal.
+func milestoneForID(c *gin.Context, db *gorm.DB, goal *Goal) (*Milestone, bool) {
+	id, err := strconv.ParseUint(c.Param("milestone"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid milestone id"})
+		return nil, false
+	}
+
+	var milestone Milestone
+	if err := db.Where("goal_id = ?", goal.ID).First(&milestone, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "milestone not found"})
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+
+	return &milestone, true
+}
+
+func getMilestones(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, ok := goalForID(c, db, user)
+		if !ok {
+			return
+		}
+
+		milestones := []Milestone{}
+		if err := db.Where("goal_id = ?", goal.ID).Order("target ASC").Find(&milestones).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, milestones)
+	}
+}
+
+func postMilestone(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, ok := goalForID(c, db, user)
+		if !ok {
+			return
+		}
+
+		var payload milestonePayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		msg, err := validateMilestone(db, goal, &payload, 0)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		milestone := Milestone{
+			UserID: user.ID,
+			GoalID: goal.ID,
+			Target: payload.Target,
+			Name:   payload.Name,
+		}
+		if err := db.Create(&milestone).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, milestone)
+	}
+}
+
+func updateMilestone(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, ok := goalForID(c, db, user)
+		if !ok {
+			return
+		}
+		milestone, ok := milestoneForID(c, db, goal)
+		if !ok {
+			return
+		}
+
+		var payload milestonePayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		msg, err := validateMilestone(db, goal, &payload, milestone.ID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		milestone.Name = payload.Name
+		milestone.Target = payload.Target
+		if err := db.Save(milestone).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, milestone)
+	}
+}
+
+func deleteMilestone(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		goal, ok := goalForID(c, db, user)
+		if !ok {
+			return
+		}
+		milestone, ok := milestoneForID(c, db, goal)
+		if !ok {
+			return
+		}
+
+		if err := db.Delete(milestone).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "milestone deleted"})
+	}
+}
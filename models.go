@@ -2,34 +2,219 @@ package main
 
 import "time"
 
+type User struct {
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	Name     string `json:"name" gorm:"uniqueIndex"`
+	Timezone string `json:"timezone"`
+	// FeedToken authenticates read-only feeds like the calendar, which are
+	// fetched by apps that can't send headers. It goes in the URL, so it is
+	// separate from the API key and can be rotated on its own. Like API keys
+	// only its prefix and a SHA-256 hash are stored.
+	FeedTokenPrefix *string `json:"-" gorm:"index"`
+	FeedTokenHash   *string `json:"-" gorm:"uniqueIndex"`
+	// BadgeToken only unlocks the badges, whose URLs are published on
+	// profiles and pages anyone can read. Stored like FeedToken.
+	BadgeTokenPrefix *string `json:"-" gorm:"index"`
+	BadgeTokenHash   *string `json:"-" gorm:"uniqueIndex"`
+	// OIDCSubject links the user to the subject of OIDC bearer tokens.
+	OIDCSubject *string   `json:"-" gorm:"column:oidc_subject;uniqueIndex"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// APIKey authenticates requests for a user. Only a SHA-256 hash of the key
+// is stored, the key itself is shown once when it is created.
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id" gorm:"index"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix" gorm:"index"`
+	Hash       string     `json:"-" gorm:"uniqueIndex"`
+	Scopes     string     `json:"-"` // comma separated
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Deployment keys are the deployment's API_KEY and follow it when it
+	// changes
+	Deployment bool `json:"-" gorm:"not null;default:false"`
+}
+
+type APIKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Key is only set in the response that creates it
+	Key string `json:"key,omitempty"`
+}
+
+// Workout is a workout type. Names are unique per user, ignoring case.
 type Workout struct {
-	ID   uint   `json:"id" gorm:"primaryKey"`
-	Name string `json:"name"`
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	UserID   uint   `json:"-" gorm:"uniqueIndex:idx_workout_user_name"`
+	Name     string `json:"name" gorm:"uniqueIndex:idx_workout_user_name,expression:LOWER(name)"`
+	Archived bool   `json:"archived" gorm:"not null;default:false"`
 }
 
+// Entry is a day the user visited the gym. A day counts as one visit no
+// matter how many sessions it holds, and a user has one entry per day.
 type Entry struct {
-	ID        uint      `json:"-" gorm:"primaryKey"`
-	Date      time.Time `json:"date"`
-	Visited   bool      `json:"visited"`
-	WorkoutID *uint     `json:"workout_id,omitempty"`
-	Workout   *Workout  `json:"workout,omitempty" gorm:"foreignKey:WorkoutID"`
+	ID       uint      `json:"-" gorm:"primaryKey"`
+	UserID   uint      `json:"-" gorm:"uniqueIndex:idx_entry_user_date"`
+	Date     time.Time `json:"date" gorm:"uniqueIndex:idx_entry_user_date"`
+	Visited  bool      `json:"visited"`
+	Sessions []Session `json:"sessions,omitempty" gorm:"foreignKey:EntryID"`
+	Sets     []SetLog  `json:"sets,omitempty" gorm:"foreignKey:EntryID"`
+}
+
+// Session is one workout within a day's entry.
+type Session struct {
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	EntryID         uint       `json:"-" gorm:"index"`
+	WorkoutID       *uint      `json:"workout_id,omitempty"`
+	Workout         *Workout   `json:"workout,omitempty" gorm:"foreignKey:WorkoutID"`
+	StartTime       *time.Time `json:"start_time,omitempty"`
+	DurationMinutes *int       `json:"duration_minutes,omitempty"`
+	// Metrics recorded by a watch, set when imported from an activity file
+	DistanceMeters      *float64 `json:"distance_meters,omitempty"`
+	ElevationGainMeters *float64 `json:"elevation_gain_meters,omitempty"`
+	AvgHeartRate        *int     `json:"avg_heart_rate,omitempty"`
+	Source              string   `json:"source,omitempty"`
 }
 
 type EntryResponse struct {
 	Date    time.Time `json:"date"`
 	Visited bool      `json:"visited"`
-	Workout *string   `json:"workout,omitempty"`
+	// Workout is the first session's workout, kept for older clients
+	Workout  *string           `json:"workout,omitempty"`
+	Sessions []SessionResponse `json:"sessions"`
+	Sets     []SetResponse     `json:"sets,omitempty"`
+}
+
+type SessionResponse struct {
+	ID                  uint       `json:"id"`
+	WorkoutID           *uint      `json:"workout_id,omitempty"`
+	Workout             *string    `json:"workout,omitempty"`
+	StartTime           *time.Time `json:"start_time,omitempty"`
+	DurationMinutes     *int       `json:"duration_minutes,omitempty"`
+	DistanceMeters      *float64   `json:"distance_meters,omitempty"`
+	ElevationGainMeters *float64   `json:"elevation_gain_meters,omitempty"`
+	AvgHeartRate        *int       `json:"avg_heart_rate,omitempty"`
+	Source              string     `json:"source,omitempty"`
 }
 
+// Exercise names are unique per user, ignoring case.
+type Exercise struct {
+	ID     uint   `json:"id" gorm:"primaryKey"`
+	UserID uint   `json:"-" gorm:"uniqueIndex:idx_exercise_user_name"`
+	Name   string `json:"name" gorm:"uniqueIndex:idx_exercise_user_name,expression:LOWER(name)"`
+}
+
+type SetLog struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	EntryID    uint      `json:"-" gorm:"index"`
+	ExerciseID uint      `json:"exercise_id"`
+	Exercise   *Exercise `json:"exercise,omitempty" gorm:"foreignKey:ExerciseID"`
+	Reps       int       `json:"reps"`
+	Weight     float64   `json:"weight"`
+	Unit       string    `json:"unit"`
+	RPE        *float64  `json:"rpe,omitempty"`
+	Order      int       `json:"order" gorm:"column:set_order"`
+}
+
+type SetResponse struct {
+	ID         uint     `json:"id"`
+	ExerciseID uint     `json:"exercise_id"`
+	Exercise   string   `json:"exercise"`
+	Reps       int      `json:"reps"`
+	Weight     float64  `json:"weight"`
+	Unit       string   `json:"unit"`
+	RPE        *float64 `json:"rpe,omitempty"`
+	Order      int      `json:"order"`
+	// Records lists the personal records this set achieved
+	Records []RecordResponse `json:"records,omitempty"`
+}
+
+// PersonalRecord is one point in an exercise's PR timeline. Weights and
+// volumes are stored in kg.
+type PersonalRecord struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	UserID     uint      `json:"-" gorm:"index"`
+	ExerciseID uint      `json:"exercise_id" gorm:"index"`
+	Exercise   *Exercise `json:"-" gorm:"foreignKey:ExerciseID"`
+	SetLogID   *uint     `json:"-" gorm:"index"`
+	Type       string    `json:"type"`
+	Value      float64   `json:"value"`
+	Reps       *int      `json:"reps,omitempty"`
+	Weight     *float64  `json:"weight,omitempty"`
+	Date       time.Time `json:"date"`
+}
+
+type RecordResponse struct {
+	ExerciseID uint      `json:"exercise_id"`
+	Exercise   string    `json:"exercise"`
+	Type       string    `json:"type"`
+	Value      float64   `json:"value"`
+	Reps       *int      `json:"reps,omitempty"`
+	Weight     *float64  `json:"weight,omitempty"`
+	Date       time.Time `json:"date"`
+}
+
+// Goal is a visit target for a period. A nil StartDate or EndDate leaves
+// that side of the period open; EndDate is the last day included.
 type Goal struct {
-	ID         uint        `json:"-" gorm:"primaryKey"`
+	ID         uint        `json:"id" gorm:"primaryKey"`
+	UserID     uint        `json:"-" gorm:"index"`
+	Name       string      `json:"name,omitempty"`
 	Value      int         `json:"value"`
+	StartDate  *time.Time  `json:"start_date,omitempty"`
+	EndDate    *time.Time  `json:"end_date,omitempty"`
+	Archived   bool        `json:"archived" gorm:"not null;default:false"`
 	Milestones []Milestone `json:"milestones,omitempty" gorm:"foreignKey:GoalID"`
 }
 
+type GoalResponse struct {
+	ID        uint    `json:"id"`
+	Name      string  `json:"name,omitempty"`
+	Value     int     `json:"value"`
+	StartDate *string `json:"start_date"`
+	EndDate   *string `json:"end_date"`
+	Archived  bool    `json:"archived"`
+	Status    string  `json:"status"`
+	Visits    int64   `json:"visits"`
+	Progress  int     `json:"progress"`
+	Achieved  bool    `json:"achieved"`
+	// Milestones is only filled in for single goal responses
+	Milestones []Milestone `json:"milestones,omitempty"`
+}
+
+// WeeklyGoal is a weekly visit target, in force from the week starting at
+// EffectiveFrom until a newer one replaces it.
+type WeeklyGoal struct {
+	ID            uint      `json:"-" gorm:"primaryKey"`
+	UserID        uint      `json:"-" gorm:"index"`
+	Value         int       `json:"value"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
 type Milestone struct {
 	ID     uint   `json:"id" gorm:"primaryKey"`
+	UserID uint   `json:"-" gorm:"index"`
 	GoalID uint   `json:"-"`
 	Target int    `json:"target"`
 	Name   string `json:"name"`
 }
+
+// RateLimitBucket is a token bucket kept in the database so replicas share
+// rate limits. Rows can be dropped once ExpiresAt passes, the bucket is full
+// again by then.
+type RateLimitBucket struct {
+	Key       string `gorm:"primaryKey"`
+	Tokens    float64
+	UpdatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+}
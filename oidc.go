@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// bearerVerifier validates OIDC bearer tokens. It is nil unless an issuer
+// is configured, in which case Authorization: Bearer works alongside X-API-Key.
+var bearerVerifier *oidcVerifier
+
+const (
+	// jwksRefreshInterval is how long fetched keys are trusted before they
+	// are fetched again.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefresh limits refetches for tokens signed with an unknown
+	// key, so bogus tokens can't hammer the identity provider, and while
+	// it is down.
+	jwksMinRefresh = time.Minute
+	// jwksFetchTimeout bounds a key set fetch, which other requests may be
+	// waiting on.
+	jwksFetchTimeout = 10 * time.Second
+	// tokenLeeway allows for clock skew with the identity provider.
+	tokenLeeway = time.Minute
+)
+
+// oidcVerifier checks the signature, issuer, audience and expiry of JWTs
+// against the keys of a JWKS.
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	jwksFile string
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+	// attempted is when the keys were last fetched, successfully or not,
+	// and err the error if not
+	attempted time.Time
+	err       error
+	// fetching is closed when the fetch in progress, if any, is done
+	fetching chan struct{}
+}
+
+// newOIDCVerifier configures a verifier for the issuer and audience, with
+// keys from the JWKS file, the JWKS URL or the issuer's discovery document.
+// It returns nil if no issuer is configured.
+func newOIDCVerifier(config OIDCConfig) *oidcVerifier {
+	if config.Issuer == "" {
+		return nil
+	}
+	return &oidcVerifier{
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		jwksURL:  config.JWKSURL,
+		jwksFile: config.JWKSFile,
+	}
+}
+
+// jwk is a JSON Web Key, with the fields of the key types that are
+// supported for signatures: RSA, EC and Ed25519.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// parseJWKS returns the signing keys of a JWKS by key ID. Keys of other
+// types or for encryption are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func fetchJSON(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tracedHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// loadJWKS reads the key set from the configured file or URL, discovering
+// the URL from the issuer if neither is set. Only one load runs at a time.
+func (v *oidcVerifier) loadJWKS(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	if v.jwksFile != "" {
+		data, err := os.ReadFile(v.jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseJWKS(data)
+	}
+
+	if v.jwksURL == "" {
+		data, err := fetchJSON(ctx, strings.TrimRight(v.issuer, "/")+"/.well-known/openid-configuration")
+		if err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+		var config struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil || config.JWKSURI == "" {
+			return nil, errors.New("OIDC discovery document has no jwks_uri")
+		}
+		v.jwksURL = config.JWKSURI
+	}
+
+	data, err := fetchJSON(ctx, v.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS failed: %w", err)
+	}
+	return parseJWKS(data)
+}
+
+// lookup returns the known key with the given ID. v.mu must be held.
+func (v *oidcVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := v.keys[kid]; ok {
+		return key, true
+	}
+	// Tokens without a key ID are fine when there's only one key
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// key returns the public key with the given ID, refetching the key set when
+// it's stale or doesn't know the ID, as happens after key rotation. Fetches
+// happen outside the lock, one at a time, and failed ones count towards
+// jwksMinRefresh too so a provider that is down isn't hammered either.
+func (v *oidcVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.lookup(kid)
+	age := time.Since(v.attempted)
+	switch {
+	case ok && age < jwksRefreshInterval:
+		v.mu.Unlock()
+		return key, nil
+	case !v.attempted.IsZero() && age < jwksMinRefresh:
+		err := v.err
+		v.mu.Unlock()
+		// Keep using the keys we have if the provider is briefly down
+		if ok {
+			return key, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	// Wait for a fetch another request started rather than starting one
+	if wait := v.fetching; wait != nil {
+		v.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return v.key(ctx, kid)
+	}
+	done := make(chan struct{})
+	v.fetching = done
+	v.mu.Unlock()
+
+	// The fetch outlives the request that started it, since others may be
+	// waiting on it
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+	keys, err := v.loadJWKS(fetchCtx)
+	cancel()
+
+	v.mu.Lock()
+	v.attempted, v.err = time.Now(), err
+	if err == nil {
+		v.keys = keys
+	}
+	v.fetching = nil
+	close(done)
+	if err != nil && ok {
+		// Keep using the keys we have if the provider is briefly down
+		v.mu.Unlock()
+		return key, nil
+	}
+	key, ok = v.lookup(kid)
+	v.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// verify validates token and returns its subject.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (string, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims,
+		func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return v.key(ctx, kid)
+		},
+		// Only asymmetric algorithms, a shared secret has no place in a JWKS
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithAudience(v.audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(tokenLeeway),
+	)
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
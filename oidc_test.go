@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	testIssuer   = "https://id.example.com"
+	testAudience = "gym-api"
+)
+
+// testSigner signs tokens with a generated key, whose public half is
+// served to the verifier from a JWKS file.
+type testSigner struct {
+	key *ecdsa.PrivateKey
+	kid string
+}
+
+func newTestSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key, kid: kid}
+}
+
+// writeJWKS writes the public keys of signers as a JWKS file.
+func writeJWKS(t *testing.T, signers ...*testSigner) string {
+	t.Helper()
+	coord := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	var keys []jwk
+	for _, s := range signers {
+		public, err := s.key.PublicKey.ECDH()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Uncompressed point: 0x04, then X and Y
+		point := public.Bytes()
+		keys = append(keys, jwk{Kty: "EC", Kid: s.kid, Use: "sig", Crv: "P-256", X: coord(point[1:33]), Y: coord(point[33:])})
+	}
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (s *testSigner) sign(t *testing.T, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = s.kid
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// validClaims are accepted by a verifier for testIssuer and testAudience.
+func validClaims(subject string) jwt.RegisteredClaims {
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		Issuer:    testIssuer,
+		Audience:  jwt.ClaimStrings{testAudience},
+		Subject:   subject,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	signer := newTestSigner(t, "key-1")
+	verifier := newOIDCVerifier(OIDCConfig{Issuer: testIssuer, Audience: testAudience, JWKSFile: writeJWKS(t, signer)})
+
+	// Signs with a key the JWKS doesn't have, under a known and an unknown ID
+	impostor := newTestSigner(t, "key-1")
+	unknown := newTestSigner(t, "key-2")
+
+	tests := []struct {
+		name   string
+		token  func() string
+		wantOK bool
+	}{
+		{"valid", func() string { return signer.sign(t, validClaims("alice")) }, true},
+		{"wrong audience", func() string {
+			claims := validClaims("alice")
+			claims.Audience = jwt.ClaimStrings{"another-api"}
+			return signer.sign(t, claims)
+		}, false},
+		{"wrong issuer", func() string {
+			claims := validClaims("alice")
+			claims.Issuer = "https://evil.example.com"
+			return signer.sign(t, claims)
+		}, false},
+		{"expired", func() string {
+			claims := validClaims("alice")
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-tokenLeeway - time.Minute))
+			return signer.sign(t, claims)
+		}, false},
+		{"expired within the leeway", func() string {
+			claims := validClaims("alice")
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-tokenLeeway / 2))
+			return signer.sign(t, claims)
+		}, true},
+		{"no expiry", func() string {
+			claims := validClaims("alice")
+			claims.ExpiresAt = nil
+			return signer.sign(t, claims)
+		}, false},
+		{"no subject", func() string { return signer.sign(t, validClaims("")) }, false},
+		{"unknown kid", func() string { return unknown.sign(t, validClaims("alice")) }, false},
+		{"wrong key", func() string { return impostor.sign(t, validClaims("alice")) }, false},
+		{"shared secret", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims("alice"))
+			token.Header["kid"] = "key-1"
+			signed, _ := token.SignedString([]byte("secret"))
+			return signed
+		}, false},
+		{"not a token", func() string { return "not-a-token" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, err := verifier.verify(context.Background(), tt.token())
+			if tt.wantOK {
+				if err != nil || subject != "alice" {
+					t.Errorf("verify = %q, %v, want alice", subject, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("verify accepted the token for %q", subject)
+			}
+		})
+	}
+}
+
+// subjectDB is a database where only the subject alice is linked, to user
+// 5.
+func subjectDB(t *testing.T) *gorm.DB {
+	db := dryRunDB(t)
+	err := db.Callback().Query().After("gorm:query").Register("test:subjects", func(tx *gorm.DB) {
+		user, ok := tx.Statement.Dest.(*User)
+		if !ok {
+			return
+		}
+		if len(tx.Statement.Vars) > 0 && tx.Statement.Vars[0] == "alice" {
+			*user = User{ID: 5, Name: "alice"}
+			return
+		}
+		_ = tx.AddError(gorm.ErrRecordNotFound)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBearerSubjectMapsToUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signer := newTestSigner(t, "key-1")
+	previous := bearerVerifier
+	bearerVerifier = newOIDCVerifier(OIDCConfig{Issuer: testIssuer, Audience: testAudience, JWKSFile: writeJWKS(t, signer)})
+	t.Cleanup(func() { bearerVerifier = previous })
+
+	r := gin.New()
+	r.GET("/me", requireUser(subjectDB(t)), func(c *gin.Context) {
+		c.String(http.StatusOK, strconv.FormatUint(uint64(currentUser(c).ID), 10))
+	})
+
+	tests := []struct {
+		name     string
+		subject  string
+		wantCode int
+		wantUser string
+	}{
+		{"linked subject", "alice", http.StatusOK, "5"},
+		{"unlinked subject", "bob", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/me", nil)
+			req.Header.Set("Authorization", "Bearer "+signer.sign(t, validClaims(tt.subject)))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantUser != "" && w.Body.String() != tt.wantUser {
+				t.Errorf("user = %s, want %s", w.Body.String(), tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ollamaGenerate asks the configured Ollama server and model to complete
+// prompt and returns the generated text.
+func ollamaGenerate(ctx context.Context, prompt string) (response string, err error) {
+	start := time.Now()
+	defer func() { observeOllama(start, err) }()
+
+	config := currentConfig().AI
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+
+	reqBody := map[string]interface{}{
+		"model":  config.Model,
+		"prompt": prompt,
+		"stream": false,
+	}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(config.URL, "/")+"/api/generate", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := tracedHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Ollama response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Ollama returned %s", resp.Status)
+	}
+
+	var ollamaResp struct {
+		Response string `json:"response"`
+	}
+	if err := json.Unmarshal(body, &ollamaResp); err != nil {
+		return "", fmt.Errorf("failed to parse Ollama response: %w", err)
+	}
+
+	return ollamaResp.Response, nil
+}
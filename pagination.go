@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// entryCursor marks the last entry of a page. Entries are ordered by date
+// and then id, so the pair identifies a position even across equal dates.
+type entryCursor struct {
+	Date time.Time
+	ID   uint
+}
+
+func (c entryCursor) encode() string {
+	raw := c.Date.UTC().Format(time.RFC3339Nano) + "|" + strconv.FormatUint(uint64(c.ID), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeEntryCursor(value string) (entryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return entryCursor{}, errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return entryCursor{}, errors.New("invalid cursor")
+	}
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return entryCursor{}, errors.New("invalid cursor")
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return entryCursor{}, errors.New("invalid cursor")
+	}
+	return entryCursor{Date: date, ID: uint(id)}, nil
+}
+
+// entryFilters scopes a query on entries to the from, to and workout query
+// parameters. from and to are inclusive YYYY-MM-DD dates, and workout
+// matches a session's workout by id or name.
+func entryFilters(c *gin.Context, db *gorm.DB, userID uint) (*gorm.DB, error) {
+	query := db.Where("entries.user_id = ?", userID)
+
+	if from := c.Query("from"); from != "" {
+		date, err := parseDate(from)
+		if err != nil {
+			return nil, errors.New("invalid from date format, use YYYY-MM-DD")
+		}
+		query = query.Where("entries.date >= ?", date)
+	}
+	if to := c.Query("to"); to != "" {
+		date, err := parseDate(to)
+		if err != nil {
+			return nil, errors.New("invalid to date format, use YYYY-MM-DD")
+		}
+		query = query.Where("entries.date < ?", date.AddDate(0, 0, 1))
+	}
+
+	if workout := c.Query("workout"); workout != "" {
+		sessions := db.Table("sessions").
+			Select("1").
+			Joins("JOIN workouts ON workouts.id = sessions.workout_id").
+			Where("sessions.entry_id = entries.id")
+		if id, err := strconv.ParseUint(workout, 10, 64); err == nil {
+			sessions = sessions.Where("workouts.id = ?", id)
+		} else {
+			sessions = sessions.Where("LOWER(workouts.name) = LOWER(?)", workout)
+		}
+		query = query.Where("EXISTS (?)", sessions)
+	}
+
+	return query, nil
+}
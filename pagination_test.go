@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestEntryCursorRoundTrip(t *testing.T) {
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+
+	for _, c := range []entryCursor{
+		{Date: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), ID: 42},
+		{Date: time.Date(2024, 3, 1, 0, 0, 0, 0, auckland), ID: 1},
+		{Date: time.Date(2024, 3, 1, 0, 0, 0, 123456789, time.UTC), ID: 0},
+	} {
+		got, err := decodeEntryCursor(c.encode())
+		if err != nil {
+			t.Fatalf("decoding %v: %v", c, err)
+		}
+		if !got.Date.Equal(c.Date) || got.ID != c.ID {
+			t.Errorf("got %v, want %v", got, c)
+		}
+	}
+}
+
+func TestDecodeEntryCursorErrors(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("2024-03-01T00:00:00Z|1"))},
+		{"no separator", encode("2024-03-01T00:00:00Z")},
+		{"date only", encode("2024-03-01|1")},
+		{"negative id", encode("2024-03-01T00:00:00Z|-1")},
+		{"id not a number", encode("2024-03-01T00:00:00Z|one")},
+		{"empty", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeEntryCursor(tt.cursor); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rateLimit allows Burst requests at once, refilled at Rate per second. The
+// zero value disables the limit.
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+func (l rateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// parseRateLimit reads limits like "120/m", which allows 120 requests at
+// once refilled evenly over a minute. The period is s, m or h, and "off"
+// disables the limit.
+func parseRateLimit(s string) (rateLimit, error) {
+	if s == "off" {
+		return rateLimit{}, nil
+	}
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, use e.g. 120/m or off", s)
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return rateLimit{}, fmt.Errorf("invalid rate limit period %q, use s, m or h", unit)
+	}
+	return rateLimit{Rate: float64(n) / period.Seconds(), Burst: float64(n)}, nil
+}
+
+// tokenBucket is the state of one client's limit.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time since it was last updated and, if a
+// token is left, removes n. Taking 0 only checks. When no token is left it
+// returns how long until there is one.
+func (b *tokenBucket) take(l rateLimit, n float64, now time.Time) (bool, time.Duration) {
+	// Replica clocks can disagree, time never runs backwards for a bucket
+	if now.After(b.updated) {
+		b.tokens = math.Min(l.Burst, b.tokens+now.Sub(b.updated).Seconds()*l.Rate)
+		b.updated = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	}
+	b.tokens = math.Max(0, b.tokens-n)
+	return true, 0
+}
+
+// fullAt is when the bucket has refilled completely and can be forgotten.
+func (b *tokenBucket) fullAt(l rateLimit) time.Time {
+	return b.updated.Add(time.Duration((l.Burst - b.tokens) / l.Rate * float64(time.Second)))
+}
+
+// limitStore keeps token buckets by key.
+type limitStore interface {
+	take(ctx context.Context, key string, l rateLimit, n float64, now time.Time) (bool, time.Duration, error)
+	// cleanup drops buckets that have refilled
+	cleanup(ctx context.Context, now time.Time) error
+}
+
+// memoryStore keeps buckets in the process, so each replica limits on its
+// own.
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	tokenBucket
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *memoryStore) take(_ context.Context, key string, l rateLimit, n float64, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok && n == 0 {
+		return true, 0, nil
+	}
+	if !ok {
+		b = &memoryBucket{tokenBucket: tokenBucket{tokens: l.Burst, updated: now}}
+		s.buckets[key] = b
+	}
+	allowed, wait := b.take(l, n, now)
+	b.expires = b.fullAt(l)
+	return allowed, wait, nil
+}
+
+func (s *memoryStore) cleanup(_ context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		if !now.Before(b.expires) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// postgresStore keeps buckets in the rate_limit_buckets table, so all
+// replicas share them. Each take locks the bucket's row.
+type postgresStore struct {
+	db *gorm.DB
+}
+
+func (s *postgresStore) take(ctx context.Context, key string, l rateLimit, n float64, now time.Time) (allowed bool, wait time.Duration, err error) {
+	// Checks don't change the bucket, so they don't need the lock
+	if n == 0 {
+		var row RateLimitBucket
+		if err := s.db.WithContext(ctx).First(&row, "key = ?", key).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return true, 0, nil
+			}
+			return false, 0, err
+		}
+		b := tokenBucket{tokens: row.Tokens, updated: row.UpdatedAt}
+		allowed, wait = b.take(l, 0, now)
+		return allowed, wait, nil
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		row := RateLimitBucket{Key: key, Tokens: l.Burst, UpdatedAt: now, ExpiresAt: now}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&row, "key = ?", key).Error; err != nil {
+			return err
+		}
+
+		b := tokenBucket{tokens: row.Tokens, updated: row.UpdatedAt}
+		allowed, wait = b.take(l, n, now)
+		return tx.Model(&row).Updates(map[string]any{
+			"tokens":     b.tokens,
+			"updated_at": b.updated,
+			"expires_at": b.fullAt(l),
+		}).Error
+	})
+	return allowed, wait, err
+}
+
+func (s *postgresStore) cleanup(ctx context.Context, now time.Time) error {
+	return s.db.WithContext(ctx).Where("expires_at <= ?", now).Delete(&RateLimitBucket{}).Error
+}
+
+// rateLimits are the limits applied to clients, parsed from the config.
+type rateLimits struct {
+	ip           rateLimit
+	writes       rateLimit
+	authFailures rateLimit
+	ai           rateLimit
+}
+
+// rateLimiter limits requests per client IP, write requests per API key,
+// failed authentication per client IP and AI requests per user, with the
+// limits currently configured.
+type rateLimiter struct {
+	store limitStore
+}
+
+// newRateLimiter keeps buckets in memory, or in postgres to share limits
+// between replicas.
+func newRateLimiter(db *gorm.DB, store string) (*rateLimiter, error) {
+	rl := &rateLimiter{}
+	switch store {
+	case "memory":
+		rl.store = newMemoryStore()
+	case "postgres":
+		if err := db.AutoMigrate(&RateLimitBucket{}); err != nil {
+			return nil, err
+		}
+		rl.store = &postgresStore{db: db}
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q, use memory or postgres", store)
+	}
+
+	go rl.cleanupLoop()
+	return rl, nil
+}
+
+func (rl *rateLimiter) cleanupLoop() {
+	for now := range time.Tick(5 * time.Minute) {
+		if err := rl.store.cleanup(context.Background(), now); err != nil {
+			slog.Warn("rate limit cleanup failed", "error", err)
+		}
+	}
+}
+
+// take takes n tokens from the bucket for key. If the store fails the
+// request is let through, rather than taking the API down with it.
+func (rl *rateLimiter) take(c *gin.Context, key string, l rateLimit, n float64) (bool, time.Duration) {
+	allowed, wait, err := rl.store.take(c.Request.Context(), key, l, n, time.Now())
+	if err != nil {
+		requestLogger(c).Warn("rate limit store failed", "error", err)
+		return true, 0
+	}
+	return allowed, wait
+}
+
+// allow takes a token for the request, and responds with 429 and
+// Retry-After if there is none left.
+func (rl *rateLimiter) allow(c *gin.Context, name, key string, l rateLimit, n float64) bool {
+	if !l.enabled() {
+		return true
+	}
+	allowed, wait := rl.take(c, name+":"+key, l, n)
+	if allowed {
+		return true
+	}
+
+	rateLimited.WithLabelValues(name).Inc()
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":       "too many requests",
+		"retry_after": retryAfter,
+	})
+	return false
+}
+
+// limitRequests limits every request but health checks by client IP. It
+// also limits how often a client IP can fail authentication, see
+// unauthorized, so API keys can't be guessed. Requests with valid
+// credentials are never held to that limit.
+func (rl *rateLimiter) limitRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.URL.Path == "/health" {
+			c.Next()
+			return
+		}
+
+		limits := currentConfig().limits
+		ip := c.ClientIP()
+		if !rl.allow(c, "ip", ip, limits.ip, 1) {
+			return
+		}
+		c.Set("auth_failures", func(c *gin.Context) bool {
+			return rl.allow(c, "auth", ip, limits.authFailures, 1)
+		})
+
+		c.Next()
+	}
+}
+
+// limitWrites limits write requests per API key, or per user for bearer
+// tokens. It goes after requireUser.
+func (rl *rateLimiter) limitWrites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if methodScope(c.Request.Method) == scopeRead {
+			c.Next()
+			return
+		}
+
+		key := fmt.Sprintf("user:%d", currentUser(c).ID)
+		if value, ok := c.Get("api_key"); ok {
+			key = fmt.Sprintf("key:%d", value.(*APIKey).ID)
+		}
+		if !rl.allow(c, "writes", key, currentConfig().limits.writes, 1) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// limitAI limits endpoints that run a model generation per user, however
+// many keys they have.
+func (rl *rateLimiter) limitAI() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !rl.allow(c, "ai", strconv.FormatUint(uint64(currentUser(c).ID), 10), currentConfig().limits.ai, 1) {
+			return
+		}
+		c.Next()
+	}
+}
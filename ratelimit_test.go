@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rateLimit
+		wantErr bool
+	}{
+		{value: "120/m", want: rateLimit{Rate: 2, Burst: 120}},
+		{value: "10/s", want: rateLimit{Rate: 10, Burst: 10}},
+		{value: "36/h", want: rateLimit{Rate: 0.01, Burst: 36}},
+		{value: "off", want: rateLimit{}},
+		{value: "", wantErr: true},
+		{value: "120", wantErr: true},
+		{value: "0/m", wantErr: true},
+		{value: "-5/m", wantErr: true},
+		{value: "many/m", wantErr: true},
+		{value: "120/d", wantErr: true},
+		{value: "120/min", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseRateLimit(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	limit := rateLimit{Rate: 1, Burst: 3} // 3 at once, one more per second
+	start := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+
+	type take struct {
+		after    time.Duration // since start
+		n        float64
+		allowed  bool
+		wait     time.Duration
+		tokensAt float64 // left afterwards
+	}
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{"burst then empty", []take{
+			{0, 1, true, 0, 2},
+			{0, 1, true, 0, 1},
+			{0, 1, true, 0, 0},
+			{0, 1, false, time.Second, 0},
+		}},
+		{"refills over time", []take{
+			{0, 3, true, 0, 0},
+			{500 * time.Millisecond, 1, false, 500 * time.Millisecond, 0.5},
+			{time.Second, 1, true, 0, 0},
+		}},
+		{"never refills past the burst", []take{
+			{time.Hour, 1, true, 0, 2},
+		}},
+		{"checking takes nothing", []take{
+			{0, 0, true, 0, 3},
+			{0, 3, true, 0, 0},
+			{0, 0, false, time.Second, 0},
+		}},
+		{"clock going backwards", []take{
+			{time.Second, 3, true, 0, 0},
+			{0, 1, false, time.Second, 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tokenBucket{tokens: limit.Burst, updated: start}
+			for i, tk := range tt.takes {
+				allowed, wait := b.take(limit, tk.n, start.Add(tk.after))
+				if allowed != tk.allowed || wait != tk.wait {
+					t.Errorf("take %d = %v, %v, want %v, %v", i, allowed, wait, tk.allowed, tk.wait)
+				}
+				if b.tokens != tk.tokensAt {
+					t.Errorf("take %d left %v tokens, want %v", i, b.tokens, tk.tokensAt)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	limit := rateLimit{Rate: 1, Burst: 2}
+	now := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+	s := newMemoryStore()
+
+	// Checking a key that was never used doesn't create its bucket
+	if allowed, _, _ := s.take(ctx, "a", limit, 0, now); !allowed || len(s.buckets) != 0 {
+		t.Fatalf("check created a bucket or was refused")
+	}
+
+	for i, want := range []bool{true, true, false} {
+		if allowed, _, _ := s.take(ctx, "a", limit, 1, now); allowed != want {
+			t.Errorf("take %d allowed = %v, want %v", i, allowed, want)
+		}
+	}
+	// Buckets are separate per key
+	if allowed, _, _ := s.take(ctx, "b", limit, 1, now); !allowed {
+		t.Error("key b was limited by key a")
+	}
+
+	// Buckets are dropped once they have refilled
+	s.cleanup(ctx, now.Add(time.Second))
+	if _, ok := s.buckets["b"]; ok {
+		t.Error("bucket b wasn't dropped after refilling")
+	}
+	if _, ok := s.buckets["a"]; !ok {
+		t.Error("bucket a was dropped before refilling")
+	}
+	s.cleanup(ctx, now.Add(2*time.Second))
+	if len(s.buckets) != 0 {
+		t.Errorf("%d buckets left after refilling", len(s.buckets))
+	}
+}
+
+// dryRunDB returns a database that builds queries without running them, so
+// every lookup finds nothing.
+func dryRunDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1"}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestAuthFailuresSpareValidKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := validConfig()
+	cfg.RateLimits.AuthFailures = "2/h"
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+
+	rl := &rateLimiter{store: newMemoryStore()}
+	r := gin.New()
+	r.Use(rl.limitRequests())
+	r.GET("/users", requireAdmin(dryRunDB(t)), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	request := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		req.RemoteAddr = "203.0.113.7:4000"
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	steps := []struct {
+		key  string
+		want int
+	}{
+		{cfg.Auth.APIKey, http.StatusOK},
+		{"guess-one", http.StatusUnauthorized},
+		{"guess-two", http.StatusUnauthorized},
+		// The failure budget is used up
+		{"guess-three", http.StatusTooManyRequests},
+		{"", http.StatusTooManyRequests},
+		// but a valid key from the same IP still gets through
+		{cfg.Auth.APIKey, http.StatusOK},
+		{"guess-four", http.StatusTooManyRequests},
+	}
+	for i, step := range steps {
+		if got := request(step.key); got != step.want {
+			t.Errorf("request %d with key %q = %d, want %d", i, step.key, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Personal record types tracked per exercise.
+const (
+	recordMaxWeight = "max_weight"
+	recordMaxReps   = "max_reps"
+	recordEst1RM    = "est_1rm"
+	recordVolume    = "max_volume"
+)
+
+var recordLabels = map[string]string{
+	recordMaxWeight: "heaviest weight",
+	recordMaxReps:   "most reps",
+	recordEst1RM:    "best estimated 1RM",
+	recordVolume:    "highest session volume",
+}
+
+const kgPerLb = 0.45359237
+
+// weightInKg converts a logged weight so sets in different units compare.
+func weightInKg(weight float64, unit string) float64 {
+	if unit == "lb" {
+		return weight * kgPerLb
+	}
+	return weight
+}
+
+// estimateOneRepMax uses the Epley formula.
+func estimateOneRepMax(weightKg float64, reps int) float64 {
+	if reps <= 1 {
+		return weightKg
+	}
+	return weightKg * (1 + float64(reps)/30)
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+// toRecordResponse renders the record's date as midnight in loc, like
+// entries.
+func toRecordResponse(r PersonalRecord, loc *time.Location) RecordResponse {
+	resp := RecordResponse{
+		ExerciseID: r.ExerciseID,
+		Type:       r.Type,
+		Value:      r.Value,
+		Reps:       r.Reps,
+		Weight:     r.Weight,
+		Date:       midnightIn(r.Date, loc),
+	}
+	if r.Exercise != nil {
+		resp.Exercise = r.Exercise.Name
+	}
+	return resp
+}
+
+// recordSet is a logged set as the record timeline sees it.
+type recordSet struct {
+	ID      uint
+	EntryID uint
+	Date    time.Time
+	Reps    int
+	Weight  float64
+	Unit    string
+}
+
+// recomputeRecords rebuilds the personal record timeline of one exercise
+// from every set logged for it. Callers run it in the transaction that
+// changed the sets, and the exercise row is locked so concurrent rebuilds
+// of the same exercise take turns.
+func recomputeRecords(db *gorm.DB, userID, exerciseID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var exercise Exercise
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", exerciseID).Find(&exercise).Error; err != nil {
+			return err
+		}
+
+		var rows []recordSet
+		if err := tx.Table("set_logs").
+			Select("set_logs.id, set_logs.entry_id, entries.date, set_logs.reps, set_logs.weight, set_logs.unit").
+			Joins("JOIN entries ON entries.id = set_logs.entry_id").
+			Where("entries.user_id = ? AND set_logs.exercise_id = ?", userID, exerciseID).
+			Order("entries.date ASC, set_logs.set_order ASC, set_logs.id ASC").
+			Scan(&rows).Error; err != nil {
+			return err
+		}
+		records := recordTimeline(userID, exerciseID, rows)
+
+		if err := tx.Where("user_id = ? AND exercise_id = ?", userID, exerciseID).Delete(&PersonalRecord{}).Error; err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		return tx.Create(&records).Error
+	})
+}
+
+// recordTimeline works out the records of one exercise from its sets in
+// the order they were done. Each time a set (or, for volume, a session)
+// beats the best so far, a record is kept with the date it was achieved.
+func recordTimeline(userID, exerciseID uint, rows []recordSet) []PersonalRecord {
+	var records []PersonalRecord
+	newRecord := func(row recordSet, recordType string, value float64) PersonalRecord {
+		setID := row.ID
+		return PersonalRecord{
+			UserID:     userID,
+			ExerciseID: exerciseID,
+			Type:       recordType,
+			Value:      roundTo(value, 2),
+			Date:       row.Date,
+			SetLogID:   &setID,
+		}
+	}
+
+	bestWeight, bestEst1RM, bestVolume := 0.0, 0.0, 0.0
+	bestRepsAt := map[float64]int{}
+	sessionVolume := 0.0
+
+	for i, row := range rows {
+		weight := roundTo(weightInKg(row.Weight, row.Unit), 2)
+
+		if weight > bestWeight {
+			bestWeight = weight
+			r := newRecord(row, recordMaxWeight, weight)
+			r.Reps = &rows[i].Reps
+			records = append(records, r)
+		}
+
+		if row.Reps > bestRepsAt[weight] {
+			bestRepsAt[weight] = row.Reps
+			w := weight
+			r := newRecord(row, recordMaxReps, float64(row.Reps))
+			r.Weight = &w
+			records = append(records, r)
+		}
+
+		if est := estimateOneRepMax(weight, row.Reps); est > bestEst1RM {
+			bestEst1RM = est
+			records = append(records, newRecord(row, recordEst1RM, est))
+		}
+
+		// Volume is compared once a session's sets have all been summed
+		sessionVolume += weight * float64(row.Reps)
+		if i == len(rows)-1 || rows[i+1].EntryID != row.EntryID {
+			if sessionVolume > bestVolume {
+				bestVolume = sessionVolume
+				r := newRecord(row, recordVolume, sessionVolume)
+				r.SetLogID = nil
+				records = append(records, r)
+			}
+			sessionVolume = 0
+		}
+	}
+
+	return records
+}
+
+// currentRecords returns the standing records of a user: the latest record
+// of each type per exercise, and for max_reps the latest one per weight.
+func currentRecords(db *gorm.DB, userID uint) ([]PersonalRecord, error) {
+	var all []PersonalRecord
+	if err := db.Preload("Exercise").Where("user_id = ?", userID).Order("date ASC, id ASC").Find(&all).Error; err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		exerciseID uint
+		recordType string
+		weight     float64
+	}
+	latest := map[key]int{}
+	var keys []key
+	for i, r := range all {
+		k := key{exerciseID: r.ExerciseID, recordType: r.Type}
+		if r.Weight != nil {
+			k.weight = *r.Weight
+		}
+		if _, ok := latest[k]; !ok {
+			keys = append(keys, k)
+		}
+		latest[k] = i
+	}
+
+	records := make([]PersonalRecord, 0, len(keys))
+	for _, k := range keys {
+		records = append(records, all[latest[k]])
+	}
+	return records, nil
+}
+
+// recordsForSet returns the records a single set achieved, so the set
+// endpoints can report new PRs right away.
+func recordsForSet(db *gorm.DB, set *SetLog, loc *time.Location) ([]RecordResponse, error) {
+	var records []PersonalRecord
+	if err := db.Preload("Exercise").Where("set_log_id = ?", set.ID).Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	var response []RecordResponse
+	for _, r := range records {
+		response = append(response, toRecordResponse(r, loc))
+	}
+	return response, nil
+}
+
+func getRecords(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		records, err := currentRecords(db, user.ID)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if len(records) == 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"message": "🏋️ No personal records yet - log some sets to start chasing PRs!",
+				"records": []RecordResponse{},
+			})
+			return
+		}
+
+		loc := userLocation(user)
+		response := make([]RecordResponse, 0, len(records))
+		latest := records[0]
+		for _, r := range records {
+			response = append(response, toRecordResponse(r, loc))
+			if r.Date.After(latest.Date) {
+				latest = r
+			}
+		}
+
+		// Celebrate the most recent PR
+		var exerciseName string
+		if latest.Exercise != nil {
+			exerciseName = latest.Exercise.Name
+		}
+		var message string
+		switch latest.Type {
+		case recordMaxReps:
+			message = fmt.Sprintf("🔥 Latest PR: %d reps of %s at %g kg on %s!", int(latest.Value), exerciseName, *latest.Weight, latest.Date.UTC().Format("January 2"))
+		case recordVolume:
+			message = fmt.Sprintf("💪 Latest PR: %g kg total volume of %s on %s!", latest.Value, exerciseName, latest.Date.UTC().Format("January 2"))
+		default:
+			message = fmt.Sprintf("🏆 Latest PR: %s %s of %g kg on %s!", exerciseName, recordLabels[latest.Type], latest.Value, latest.Date.UTC().Format("January 2"))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": message,
+			"records": response,
+		})
+	}
+}
+
+func getRecordHistory(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		// The exercise can be given by id or by name
+		var exercise Exercise
+		query := db.Where("user_id = ?", user.ID)
+		if id, err := strconv.ParseUint(c.Param("exercise"), 10, 64); err == nil {
+			query = query.Where("id = ?", id)
+		} else {
+			query = query.Where("LOWER(name) = LOWER(?)", c.Param("exercise"))
+		}
+		if err := query.First(&exercise).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "exercise not found"})
+				return
+			}
+			internalError(c, err)
+			return
+		}
+
+		historyQuery := db.Where("user_id = ? AND exercise_id = ?", user.ID, exercise.ID)
+		if recordType := c.Query("type"); recordType != "" {
+			if _, ok := recordLabels[recordType]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "type must be one of max_weight, max_reps, est_1rm, max_volume"})
+				return
+			}
+			historyQuery = historyQuery.Where("type = ?", recordType)
+		}
+
+		var records []PersonalRecord
+		if err := historyQuery.Order("date ASC, id ASC").Find(&records).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		loc := userLocation(user)
+		history := make([]RecordResponse, 0, len(records))
+		for _, r := range records {
+			r.Exercise = &exercise
+			history = append(history, toRecordResponse(r, loc))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"exercise": exercise.Name,
+			"history":  history,
+		})
+	}
+}
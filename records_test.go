@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// describeRecord formats a record with the fields that identify it.
+func describeRecord(r PersonalRecord) string {
+	s := fmt.Sprintf("%s %g on %s", r.Type, r.Value, formatDate(r.Date))
+	if r.Reps != nil {
+		s += fmt.Sprintf(" reps=%d", *r.Reps)
+	}
+	if r.Weight != nil {
+		s += fmt.Sprintf(" weight=%g", *r.Weight)
+	}
+	if r.SetLogID != nil {
+		s += fmt.Sprintf(" set=%d", *r.SetLogID)
+	}
+	return s
+}
+
+func TestRecordTimeline(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		sets []recordSet
+		want []string
+	}{
+		{"no sets", nil, nil},
+		{
+			name: "progression over sessions",
+			sets: []recordSet{
+				{ID: 1, EntryID: 1, Date: day(1), Reps: 5, Weight: 100, Unit: "kg"},
+				{ID: 2, EntryID: 1, Date: day(1), Reps: 6, Weight: 100, Unit: "kg"},
+				// Ties the best estimated 1RM, which isn't a record
+				{ID: 3, EntryID: 2, Date: day(2), Reps: 10, Weight: 90, Unit: "kg"},
+				{ID: 4, EntryID: 3, Date: day(3), Reps: 3, Weight: 102.5, Unit: "kg"},
+			},
+			want: []string{
+				"max_weight 100 on 2024-03-01 reps=5 set=1",
+				"max_reps 5 on 2024-03-01 weight=100 set=1",
+				"est_1rm 116.67 on 2024-03-01 set=1",
+				"max_reps 6 on 2024-03-01 weight=100 set=2",
+				"est_1rm 120 on 2024-03-01 set=2",
+				"max_volume 1100 on 2024-03-01",
+				"max_reps 10 on 2024-03-02 weight=90 set=3",
+				"max_weight 102.5 on 2024-03-03 reps=3 set=4",
+				"max_reps 3 on 2024-03-03 weight=102.5 set=4",
+			},
+		},
+		{
+			name: "pounds are converted",
+			sets: []recordSet{
+				{ID: 7, EntryID: 1, Date: day(1), Reps: 1, Weight: 225, Unit: "lb"},
+			},
+			want: []string{
+				"max_weight 102.06 on 2024-03-01 reps=1 set=7",
+				"max_reps 1 on 2024-03-01 weight=102.06 set=7",
+				"est_1rm 102.06 on 2024-03-01 set=7",
+				"max_volume 102.06 on 2024-03-01",
+			},
+		},
+		{
+			name: "volume is summed per session",
+			sets: []recordSet{
+				{ID: 1, EntryID: 1, Date: day(1), Reps: 10, Weight: 50, Unit: "kg"},
+				{ID: 2, EntryID: 2, Date: day(2), Reps: 8, Weight: 40, Unit: "kg"},
+				{ID: 3, EntryID: 2, Date: day(2), Reps: 8, Weight: 40, Unit: "kg"},
+			},
+			want: []string{
+				"max_weight 50 on 2024-03-01 reps=10 set=1",
+				"max_reps 10 on 2024-03-01 weight=50 set=1",
+				"est_1rm 66.67 on 2024-03-01 set=1",
+				"max_volume 500 on 2024-03-01",
+				"max_reps 8 on 2024-03-02 weight=40 set=2",
+				"max_volume 640 on 2024-03-02",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := recordTimeline(1, 2, tt.sets)
+			var got []string
+			for _, r := range records {
+				if r.UserID != 1 || r.ExerciseID != 2 {
+					t.Errorf("record for user %d exercise %d, want user 1 exercise 2", r.UserID, r.ExerciseID)
+				}
+				got = append(got, describeRecord(r))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got records\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordResponseDate(t *testing.T) {
+	// Records are stored on the calendar day, as midnight UTC
+	record := PersonalRecord{ExerciseID: 2, Type: recordMaxWeight, Value: 100, Date: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)}
+
+	for _, name := range []string{"America/Los_Angeles", "UTC", "Pacific/Auckland"} {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := toRecordResponse(record, loc).Date
+		if want := time.Date(2024, 3, 5, 0, 0, 0, 0, loc); !got.Equal(want) || got.Location() != loc {
+			t.Errorf("in %s date = %s, want %s", name, got, want)
+		}
+		// It renders on the same day as an entry for the day would
+		if entry := toEntryResponse(Entry{Date: record.Date}, loc); !entry.Date.Equal(got) {
+			t.Errorf("in %s record date %s, entry date %s", name, got, entry.Date)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// sessionOrder sorts a day's sessions chronologically, untimed ones last.
+const sessionOrder = "start_time ASC NULLS LAST, id ASC"
+
+func preloadSessions(db *gorm.DB) *gorm.DB {
+	return db.Preload("Sessions", func(db *gorm.DB) *gorm.DB {
+		return db.Order(sessionOrder)
+	}).Preload("Sessions.Workout")
+}
+
+// sessionPayload holds the session fields accepted by the entry and session
+// endpoints.
+type sessionPayload struct {
+	WorkoutID       *uint  `json:"workout_id"`
+	StartTime       string `json:"start_time"`
+	DurationMinutes *int   `json:"duration_minutes"`
+}
+
+// empty reports whether no session fields were given.
+func (p *sessionPayload) empty() bool {
+	return p.WorkoutID == nil && p.StartTime == "" && p.DurationMinutes == nil
+}
+
+// apply validates the payload and copies it onto session, returning a
+// user-facing message when it is invalid. The start time is either RFC 3339
+// or HH:MM on the entry's day in loc.
+func (p *sessionPayload) apply(session *Session, day time.Time, loc *time.Location) string {
+	session.WorkoutID = p.WorkoutID
+	session.DurationMinutes = p.DurationMinutes
+	session.StartTime = nil
+
+	if p.DurationMinutes != nil && *p.DurationMinutes <= 0 {
+		return "duration_minutes must be positive"
+	}
+
+	if p.StartTime != "" {
+		if t, err := time.Parse(time.RFC3339, p.StartTime); err == nil {
+			if !dateIn(t, loc).Equal(day) {
+				return "start_time must be on the entry's date"
+			}
+			session.StartTime = &t
+		} else if clock, err := time.Parse("15:04", p.StartTime); err == nil {
+			y, m, d := day.UTC().Date()
+			t := time.Date(y, m, d, clock.Hour(), clock.Minute(), 0, 0, loc)
+			session.StartTime = &t
+		} else {
+			return "invalid start_time format, use HH:MM or RFC 3339"
+		}
+	}
+
+	return ""
+}
+
+func toSessionResponse(s Session, loc *time.Location) SessionResponse {
+	resp := SessionResponse{
+		ID:              s.ID,
+		WorkoutID:       s.WorkoutID,
+		DurationMinutes: s.DurationMinutes,
+
+		DistanceMeters:      s.DistanceMeters,
+		ElevationGainMeters: s.ElevationGainMeters,
+		AvgHeartRate:        s.AvgHeartRate,
+		Source:              s.Source,
+	}
+	if s.Workout != nil {
+		resp.Workout = &s.Workout.Name
+	}
+	if s.StartTime != nil {
+		start := s.StartTime.In(loc)
+		resp.StartTime = &start
+	}
+	return resp
+}
+
+// migrateEntryWorkouts moves the single workout_id entries used to have
+// into a session per entry, then drops the old column.
+func migrateEntryWorkouts(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Entry{}, "workout_id") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			ID        uint
+			WorkoutID uint
+		}
+		if err := tx.Table("entries").Select("id, workout_id").Where("workout_id IS NOT NULL").Scan(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			workoutID := row.WorkoutID
+			session := Session{EntryID: row.ID, WorkoutID: &workoutID}
+			if err := tx.Create(&session).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Migrator().DropColumn(&Entry{}, "workout_id")
+	})
+}
+
+// sessionForEntry loads the session identified by the :id path parameter
+// within entry.
+func sessionForEntry(c *gin.Context, db *gorm.DB, entry *Entry) (*Session, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return nil, false
+	}
+
+	var session Session
+	if err := db.Where("entry_id = ?", entry.ID).First(&session, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+
+	return &session, true
+}
+
+func getSessions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+
+		var sessions []Session
+		if err := db.Preload("Workout").Where("entry_id = ?", entry.ID).Order(sessionOrder).Find(&sessions).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		loc := userLocation(user)
+		response := []SessionResponse{}
+		for _, s := range sessions {
+			response = append(response, toSessionResponse(s, loc))
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func postSession(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+
+		var payload sessionPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		loc := userLocation(user)
+		session := Session{EntryID: entry.ID}
+		if msg := payload.apply(&session, entry.Date, loc); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		if session.WorkoutID != nil && !checkWorkout(c, db, user, *session.WorkoutID, nil) {
+			return
+		}
+
+		if err := db.Create(&session).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if err := db.Preload("Workout").First(&session, session.ID).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, toSessionResponse(session, loc))
+	}
+}
+
+func updateSession(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+		session, ok := sessionForEntry(c, db, entry)
+		if !ok {
+			return
+		}
+
+		var payload sessionPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		loc := userLocation(user)
+		current := session.WorkoutID
+		if msg := payload.apply(session, entry.Date, loc); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		if session.WorkoutID != nil && !checkWorkout(c, db, user, *session.WorkoutID, current) {
+			return
+		}
+
+		if err := db.Select("WorkoutID", "StartTime", "DurationMinutes").Updates(session).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if err := db.Preload("Workout").First(session, session.ID).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, toSessionResponse(*session, loc))
+	}
+}
+
+func deleteSession(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+		session, ok := sessionForEntry(c, db, entry)
+		if !ok {
+			return
+		}
+
+		// The day stays a visit, use DELETE /entry/{date} to remove it
+		if err := db.Delete(session).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "session deleted"})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// setPayload is the request body for creating or replacing a logged set.
+type setPayload struct {
+	ExerciseID uint     `json:"exercise_id"`
+	Reps       int      `json:"reps"`
+	Weight     float64  `json:"weight"`
+	Unit       string   `json:"unit"`
+	RPE        *float64 `json:"rpe"`
+	Order      *int     `json:"order"`
+}
+
+// validate normalizes the unit and checks the payload, returning a
+// user-facing message when it is invalid.
+func (p *setPayload) validate() string {
+	if p.ExerciseID == 0 {
+		return "exercise_id is required"
+	}
+	if p.Reps <= 0 {
+		return "reps must be positive"
+	}
+	if p.Weight < 0 {
+		return "weight must not be negative"
+	}
+	p.Unit = strings.ToLower(strings.TrimSpace(p.Unit))
+	if p.Unit == "" {
+		p.Unit = "kg"
+	}
+	if p.Unit != "kg" && p.Unit != "lb" {
+		return "unit must be kg or lb"
+	}
+	if p.RPE != nil && (*p.RPE < 1 || *p.RPE > 10) {
+		return "rpe must be between 1 and 10"
+	}
+	return ""
+}
+
+func toSetResponse(s SetLog) SetResponse {
+	resp := SetResponse{
+		ID:         s.ID,
+		ExerciseID: s.ExerciseID,
+		Reps:       s.Reps,
+		Weight:     s.Weight,
+		Unit:       s.Unit,
+		RPE:        s.RPE,
+		Order:      s.Order,
+	}
+	if s.Exercise != nil {
+		resp.Exercise = s.Exercise.Name
+	}
+	return resp
+}
+
+// entryForDate loads the caller's entry for the :date path parameter. It
+// writes the error response itself and returns false if there is none.
+func entryForDate(c *gin.Context, db *gorm.DB, user *User) (*Entry, bool) {
+	date, err := parseDate(c.Param("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date format, use YYYY-MM-DD"})
+		return nil, false
+	}
+
+	var entry Entry
+	if err := onDay(db, user.ID, date).First(&entry).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no entry found for this date"})
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+
+	return &entry, true
+}
+
+// setForEntry loads the set identified by the :id path parameter within entry.
+func setForEntry(c *gin.Context, db *gorm.DB, entry *Entry) (*SetLog, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid set id"})
+		return nil, false
+	}
+
+	var set SetLog
+	if err := db.Where("entry_id = ?", entry.ID).First(&set, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "set not found"})
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+
+	return &set, true
+}
+
+// checkExercise verifies the exercise exists and belongs to user.
+func checkExercise(c *gin.Context, db *gorm.DB, user *User, exerciseID uint) bool {
+	var exercise Exercise
+	if err := db.Where("user_id = ?", user.ID).First(&exercise, exerciseID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "exercise not found"})
+			return false
+		}
+		internalError(c, err)
+		return false
+	}
+	return true
+}
+
+func getExercises(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		exercises := []Exercise{}
+		if err := db.Where("user_id = ?", user.ID).Order("name ASC").Find(&exercises).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, exercises)
+	}
+}
+
+func postExercise(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		name := strings.TrimSpace(payload.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+			return
+		}
+
+		// Exercise names are unique per user, ignoring case
+		var existing Exercise
+		if err := db.Where("user_id = ? AND LOWER(name) = LOWER(?)", user.ID, name).First(&existing).Error; err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "exercise already exists", "id": existing.ID})
+			return
+		} else if err != gorm.ErrRecordNotFound {
+			internalError(c, err)
+			return
+		}
+
+		exercise := Exercise{UserID: user.ID, Name: name}
+		if err := db.Create(&exercise).Error; err != nil {
+			// Another request created it since it was checked
+			if errors.Is(err, gorm.ErrDuplicatedKey) && db.Where("user_id = ? AND LOWER(name) = LOWER(?)", user.ID, name).First(&existing).Error == nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "exercise already exists", "id": existing.ID})
+				return
+			}
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, exercise)
+	}
+}
+
+func getSets(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+
+		var sets []SetLog
+		if err := db.Preload("Exercise").Where("entry_id = ?", entry.ID).Order("set_order ASC, id ASC").Find(&sets).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		response := []SetResponse{}
+		for _, s := range sets {
+			response = append(response, toSetResponse(s))
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func postSet(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+
+		var payload setPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if msg := payload.validate(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		if !checkExercise(c, db, user, payload.ExerciseID) {
+			return
+		}
+
+		set := SetLog{
+			EntryID:    entry.ID,
+			ExerciseID: payload.ExerciseID,
+			Reps:       payload.Reps,
+			Weight:     payload.Weight,
+			Unit:       payload.Unit,
+			RPE:        payload.RPE,
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// Append to the end of the session unless an order was given
+			if payload.Order != nil {
+				set.Order = *payload.Order
+			} else {
+				var maxOrder int
+				if err := tx.Model(&SetLog{}).Where("entry_id = ?", entry.ID).Select("COALESCE(MAX(set_order), 0)").Scan(&maxOrder).Error; err != nil {
+					return err
+				}
+				set.Order = maxOrder + 1
+			}
+
+			if err := tx.Create(&set).Error; err != nil {
+				return err
+			}
+			return recomputeRecords(tx, user.ID, set.ExerciseID)
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if err := db.Preload("Exercise").First(&set, set.ID).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		response := toSetResponse(set)
+		records, err := recordsForSet(db, &set, userLocation(user))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		response.Records = records
+
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+func updateSet(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+		set, ok := setForEntry(c, db, entry)
+		if !ok {
+			return
+		}
+
+		var payload setPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if msg := payload.validate(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		if !checkExercise(c, db, user, payload.ExerciseID) {
+			return
+		}
+
+		previousExerciseID := set.ExerciseID
+		set.ExerciseID = payload.ExerciseID
+		set.Reps = payload.Reps
+		set.Weight = payload.Weight
+		set.Unit = payload.Unit
+		set.RPE = payload.RPE
+		if payload.Order != nil {
+			set.Order = *payload.Order
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(set).Error; err != nil {
+				return err
+			}
+
+			// Records may need rebuilding for both exercises if it changed
+			if previousExerciseID != set.ExerciseID {
+				if err := recomputeRecords(tx, user.ID, previousExerciseID); err != nil {
+					return err
+				}
+			}
+			return recomputeRecords(tx, user.ID, set.ExerciseID)
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if err := db.Preload("Exercise").First(set, set.ID).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		response := toSetResponse(*set)
+		records, err := recordsForSet(db, set, userLocation(user))
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		response.Records = records
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func deleteSet(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		entry, ok := entryForDate(c, db, user)
+		if !ok {
+			return
+		}
+		set, ok := setForEntry(c, db, entry)
+		if !ok {
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(set).Error; err != nil {
+				return err
+			}
+			return recomputeRecords(tx, user.ID, set.ExerciseID)
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "set deleted"})
+	}
+}
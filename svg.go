@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hexColor matches the colors accepted in query parameters, with or without
+// the leading # since that has to be escaped in URLs.
+var hexColor = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// namedColors are the color names shields.io badges understand.
+var namedColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"lightgrey":   "#9f9f9f",
+	"grey":        "#555",
+}
+
+// colorParam reads a hex or named color from the query, falling back to
+// def. Nothing else is accepted so the value can't break the SVG markup.
+func colorParam(c *gin.Context, name, def string) (string, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return def, true
+	}
+	if color, ok := namedColors[value]; ok {
+		return color, true
+	}
+	if !hexColor.MatchString(value) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be a hex color like 216e39 or a name like brightgreen", name)})
+		return "", false
+	}
+	return "#" + strings.TrimPrefix(value, "#"), true
+}
+
+// writeSVG sends an SVG image that clients may cache for maxAge seconds,
+// answering with 304 Not Modified when the client already has the same
+// image. Proxies may only cache images fetched with a feed or badge token,
+// whose URL is unique to the user; with an auth header the same URL serves
+// everyone.
+func writeSVG(c *gin.Context, svg string, maxAge int) {
+	sum := sha256.Sum256([]byte(svg))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	visibility := "public"
+	if _, ok := c.GetQuery("token"); !ok {
+		visibility = "private"
+		c.Header("Vary", "X-API-Key, Authorization")
+	}
+	c.Header("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, maxAge))
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "image/svg+xml; charset=utf-8", []byte(svg))
+}
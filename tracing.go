@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// serviceName identifies the API in traces unless OTEL_SERVICE_NAME is set.
+const serviceName = "gym-api"
+
+// setupTracing installs the global tracer provider. The exporter is picked
+// with OTEL_TRACES_EXPORTER: otlp, console for stdout, or none. When unset,
+// traces are exported over OTLP/HTTP if an OTLP endpoint is configured and
+// not at all otherwise. The exporter itself reads the standard OTEL_*
+// variables. The returned function flushes pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	name := os.Getenv("OTEL_TRACES_EXPORTER")
+	if name == "" {
+		name = "none"
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			name = "otlp"
+		}
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name {
+	case "none":
+		// The no-op provider still passes on trace IDs sent by callers
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "console", "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q, use otlp, console or none", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Later options take precedence, so OTEL_SERVICE_NAME wins
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a span for every request, continuing the
+// caller's trace if it sent a traceparent header. Health checks and
+// scrapes are left out since they'd drown everything else.
+func tracingMiddleware() gin.HandlerFunc {
+	return otelgin.Middleware(serviceName, otelgin.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/health" && r.URL.Path != "/metrics"
+	}))
+}
+
+// traceIDMiddleware returns the request's trace ID in the X-Trace-ID header
+// and keeps it on the context for the request's log lines.
+func traceIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sc := trace.SpanContextFromContext(c.Request.Context()); sc.HasTraceID() {
+			c.Header("X-Trace-ID", sc.TraceID().String())
+			c.Set("trace_id", sc.TraceID().String())
+		}
+		c.Next()
+	}
+}
+
+// registerDBTracing adds a span for every GORM query made with a request's
+// context. Queries outside of a traced request, like migrations and metric
+// scrapes, are left out.
+func registerDBTracing(db *gorm.DB) error {
+	const spanKey = "tracing:span"
+	tracer := otel.Tracer("gym-api/gorm")
+
+	before := func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+		ctx, span := tracer.Start(ctx, "gorm", trace.WithSpanKind(trace.SpanKindClient))
+		db.Statement.Context = ctx
+		db.InstanceSet(spanKey, span)
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			value, ok := db.InstanceGet(spanKey)
+			if !ok {
+				return
+			}
+			span := value.(trace.Span)
+			defer span.End()
+
+			table := gormTable(db)
+			span.SetName(operation + " " + table)
+			span.SetAttributes(
+				attribute.String("db.system", "postgresql"),
+				attribute.String("db.operation", operation),
+				attribute.String("db.sql.table", table),
+				// The SQL has placeholders, values aren't recorded
+				attribute.String("db.statement", db.Statement.SQL.String()),
+				attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+			)
+			if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+				span.RecordError(db.Error)
+				span.SetStatus(codes.Error, db.Error.Error())
+			}
+		}
+	}
+
+	return aroundGorm(db, "tracing", before, after)
+}
+
+// tracedHTTPClient makes outbound requests as child spans of the context
+// they're made with and passes the trace on.
+var tracedHTTPClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// seedUser creates the default goal, milestones and workout types for a user
+// if they don't have them yet.
+func seedUser(db *gorm.DB, user *User) error {
+	// Ensure goal exists
+	var goal Goal
+	if err := db.Where("user_id = ?", user.ID).First(&goal).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return err
+		}
+		goal = Goal{UserID: user.ID, Value: currentConfig().Goals.Visits}
+		if err := db.Create(&goal).Error; err != nil {
+			return err
+		}
+	}
+
+	// Seed milestones if none exist
+	var milestoneCount int64
+	if err := db.Model(&Milestone{}).Where("user_id = ?", user.ID).Count(&milestoneCount).Error; err != nil {
+		return err
+	}
+	if milestoneCount == 0 {
+		milestones := []Milestone{
+			{UserID: user.ID, GoalID: goal.ID, Target: 15, Name: "Getting Started"},
+			{UserID: user.ID, GoalID: goal.ID, Target: 30, Name: "Building Habits"},
+			{UserID: user.ID, GoalID: goal.ID, Target: 50, Name: "Halfway Hero"},
+			{UserID: user.ID, GoalID: goal.ID, Target: 75, Name: "On Fire"},
+			{UserID: user.ID, GoalID: goal.ID, Target: 100, Name: "Goal Crusher"},
+		}
+		if err := db.Create(&milestones).Error; err != nil {
+			return err
+		}
+	}
+
+	// Seed workouts if none exist
+	var workoutCount int64
+	if err := db.Model(&Workout{}).Where("user_id = ?", user.ID).Count(&workoutCount).Error; err != nil {
+		return err
+	}
+	if workoutCount == 0 {
+		workouts := []Workout{
+			{UserID: user.ID, Name: "Push"},
+			{UserID: user.ID, Name: "Pull"},
+			{UserID: user.ID, Name: "Legs"},
+			{UserID: user.ID, Name: "Cardio"},
+		}
+		if err := db.Create(&workouts).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateLegacyData assigns rows created before multi-user support to a
+// "default" user whose API key is the deployment's API_KEY, with all
+// scopes, so existing clients keep working unchanged. The key follows
+// API_KEY when it is rotated.
+func migrateLegacyData(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var userCount int64
+		if err := tx.Model(&User{}).Count(&userCount).Error; err != nil {
+			return err
+		}
+		if userCount > 0 {
+			return nil
+		}
+
+		user := User{Name: "default"}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		key := storedAPIKey(user.ID, "default", adminAPIKey(), []string{scopeRead, scopeWrite, scopeAdmin}, nil)
+		key.Deployment = true
+		if err := tx.Create(&key).Error; err != nil {
+			return err
+		}
+
+		// Legacy rows all go to one user, so they must not share a day or name
+		if err := mergeDuplicates(tx); err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&Workout{}, &Entry{}, &Goal{}, &Milestone{}} {
+			if err := tx.Model(model).Where("user_id IS NULL OR user_id = 0").Update("user_id", user.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		return seedUser(tx, &user)
+	})
+}
+
+// duplicates describes rows of a table that are merged into one when they
+// share key, which is kept unique by an index.
+type duplicates struct {
+	table string
+	key   string
+	// order picks the row to keep, the first in this order
+	order string
+	// refs are the "table.column"s pointing at the rows, which are moved to
+	// the row kept
+	refs []string
+}
+
+var userDuplicates = []duplicates{
+	{"entries", "COALESCE(user_id, 0), date", "visited DESC, id", []string{"sessions.entry_id", "set_logs.entry_id"}},
+	{"workouts", "COALESCE(user_id, 0), LOWER(name)", "archived IS TRUE, id", []string{"sessions.workout_id"}},
+	{"exercises", "COALESCE(user_id, 0), LOWER(name)", "id", []string{"set_logs.exercise_id", "personal_records.exercise_id"}},
+}
+
+// mergeDuplicates merges visits on the same day and workouts and exercises
+// with the same name, which could be created by concurrent requests before
+// they had unique indexes. Tables from before multi-user support are left
+// to migrateLegacyData.
+func mergeDuplicates(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, d := range userDuplicates {
+			if !tx.Migrator().HasColumn(d.table, "user_id") {
+				continue
+			}
+			merged, err := d.merge(tx)
+			if err != nil {
+				return err
+			}
+
+			// The PR timelines of merged exercises were interleaved
+			if d.table != "exercises" {
+				continue
+			}
+			for _, row := range merged {
+				if err := recomputeRecords(tx, row.UserID, row.ID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// merge moves the references to duplicate rows onto the row kept and
+// deletes the rest, returning the rows that had duplicates.
+func (d duplicates) merge(tx *gorm.DB) ([]struct{ ID, UserID uint }, error) {
+	keep := fmt.Sprintf("SELECT id, FIRST_VALUE(id) OVER (PARTITION BY %s ORDER BY %s) AS keep FROM %s", d.key, d.order, d.table)
+
+	var merged []struct{ ID, UserID uint }
+	if err := tx.Raw(fmt.Sprintf("SELECT id, COALESCE(user_id, 0) AS user_id FROM %s WHERE id IN (SELECT keep FROM (%s) d WHERE id <> keep)", d.table, keep)).
+		Scan(&merged).Error; err != nil {
+		return nil, err
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+
+	for _, ref := range d.refs {
+		table, column, _ := strings.Cut(ref, ".")
+		if !tx.Migrator().HasTable(table) {
+			continue
+		}
+		if err := tx.Exec(fmt.Sprintf("UPDATE %[1]s SET %[2]s = d.keep FROM (%[3]s) d WHERE %[1]s.%[2]s = d.id AND d.id <> d.keep", table, column, keep)).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM (%s) d WHERE id <> keep)", d.table, keep)).Error; err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func createUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
+		var payload struct {
+			Name        string `json:"name"`
+			OIDCSubject string `json:"oidc_subject"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		name := strings.TrimSpace(payload.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+			return
+		}
+
+		subject := strings.TrimSpace(payload.OIDCSubject)
+		if subject != "" && !checkSubjectFree(c, db, subject, 0) {
+			return
+		}
+
+		// Check if the name is already taken
+		var count int64
+		if err := db.Model(&User{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "user already exists"})
+			return
+		}
+
+		user := User{Name: name}
+		if subject != "" {
+			user.OIDCSubject = &subject
+		}
+		var apiKey string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+
+			key, secret, err := newAPIKey(user.ID, "default", defaultScopes, nil)
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&key).Error; err != nil {
+				return err
+			}
+			apiKey = secret
+
+			return seedUser(tx, &user)
+		})
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		// The key is only ever returned here
+		c.JSON(http.StatusCreated, gin.H{
+			"id":           user.ID,
+			"name":         user.Name,
+			"oidc_subject": user.OIDCSubject,
+			"api_key":      apiKey,
+		})
+	}
+}
+
+// checkSubjectFree makes sure no user other than excludeID is linked to the
+// OIDC subject.
+func checkSubjectFree(c *gin.Context, db *gorm.DB, subject string, excludeID uint) bool {
+	var count int64
+	if err := db.Model(&User{}).Where("oidc_subject = ? AND id <> ?", subject, excludeID).Count(&count).Error; err != nil {
+		internalError(c, err)
+		return false
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "another user is linked to this subject"})
+		return false
+	}
+	return true
+}
+
+// updateUser links a user to an OIDC subject, or unlinks them with an
+// empty one.
+func updateUser(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+
+		user, ok := userForID(c, db)
+		if !ok {
+			return
+		}
+
+		var payload struct {
+			OIDCSubject *string `json:"oidc_subject"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if payload.OIDCSubject == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "oidc_subject is required, use \"\" to unlink"})
+			return
+		}
+
+		var subject *string
+		if trimmed := strings.TrimSpace(*payload.OIDCSubject); trimmed != "" {
+			if !checkSubjectFree(c, db, trimmed, user.ID) {
+				return
+			}
+			subject = &trimmed
+		}
+
+		if err := db.Model(user).Update("oidc_subject", subject).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":           user.ID,
+			"name":         user.Name,
+			"oidc_subject": subject,
+		})
+	}
+}
+
+func getMe() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":                 user.ID,
+			"name":               user.Name,
+			"timezone":           user.Timezone,
+			"effective_timezone": userLocation(user).String(),
+		})
+	}
+}
+
+func updateMe(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		var payload struct {
+			Timezone string `json:"timezone"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// An empty timezone falls back to the deployment's TIMEZONE
+		timezone := strings.TrimSpace(payload.Timezone)
+		if timezone != "" {
+			if _, err := time.LoadLocation(timezone); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid timezone, use an IANA name like Pacific/Auckland"})
+				return
+			}
+		}
+
+		if err := db.Model(user).Update("timezone", timezone).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "profile updated"})
+	}
+}
+
+// migrateFeedTokens hashes the plaintext feed tokens users used to have,
+// then drops the old column. Calendar subscriptions keep working.
+func migrateFeedTokens(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&User{}, "feed_token") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			ID        uint
+			FeedToken string
+		}
+		if err := tx.Table("users").Select("id, feed_token").Where("feed_token IS NOT NULL AND feed_token <> ''").Scan(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if err := tx.Model(&User{}).Where("id = ?", row.ID).Updates(map[string]any{
+				"feed_token_prefix": apiKeyPrefix(row.FeedToken),
+				"feed_token_hash":   hashAPIKey(row.FeedToken),
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Migrator().DropColumn(&User{}, "feed_token")
+	})
+}
+
+// rotateURLToken issues a new token of the given kind, which stops any
+// URLs using the old one from working. links are the URLs to respond with
+// for the token.
+func rotateURLToken(db *gorm.DB, kind urlToken, links func(token string) gin.H) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		token, err := generateAPIKey()
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+
+		if err := db.Model(user).Updates(map[string]any{
+			kind.column + "_prefix": apiKeyPrefix(token),
+			kind.column + "_hash":   hashAPIKey(token),
+		}).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		response := links(token)
+		response[kind.column] = token
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func revokeURLToken(db *gorm.DB, kind urlToken) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		if err := db.Model(user).Updates(map[string]any{
+			kind.column + "_prefix": nil,
+			kind.column + "_hash":   nil,
+		}).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": kind.name + " revoked"})
+	}
+}
+
+// rotateFeedToken issues a new feed token, which stops any calendar
+// subscriptions using the old one.
+func rotateFeedToken(db *gorm.DB) gin.HandlerFunc {
+	return rotateURLToken(db, feedToken, func(token string) gin.H {
+		return gin.H{"calendar_url": "/calendar.ics?token=" + token}
+	})
+}
+
+// rotateBadgeToken issues a new badge token, which breaks any badges
+// embedded with the old one.
+func rotateBadgeToken(db *gorm.DB) gin.HandlerFunc {
+	return rotateURLToken(db, badgeToken, func(token string) gin.H {
+		return gin.H{"streak_badge_url": "/badges/streak.svg?token=" + token}
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// workoutForID loads the caller's workout identified by the :id path
+// parameter. It writes the error response itself and returns false if there
+// is none.
+func workoutForID(c *gin.Context, db *gorm.DB, user *User) (*Workout, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid workout id"})
+		return nil, false
+	}
+
+	var workout Workout
+	if err := db.Where("user_id = ?", user.ID).First(&workout, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "workout not found"})
+			return nil, false
+		}
+		internalError(c, err)
+		return nil, false
+	}
+
+	return &workout, true
+}
+
+// checkWorkout verifies the workout exists, belongs to user and isn't
+// archived. An archived workout is still accepted when it equals current,
+// the workout already assigned. It writes the error response itself.
+func checkWorkout(c *gin.Context, db *gorm.DB, user *User, workoutID uint, current *uint) bool {
+	var workout Workout
+	if err := db.Where("user_id = ?", user.ID).First(&workout, workoutID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "workout not found"})
+			return false
+		}
+		internalError(c, err)
+		return false
+	}
+	if workout.Archived && (current == nil || *current != workout.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workout is archived"})
+		return false
+	}
+	return true
+}
+
+// workoutNameTaken reports whether the user has another workout type with
+// the same name, ignoring case. Archived types count so they can be restored.
+func workoutNameTaken(db *gorm.DB, userID uint, name string, excludeID uint) (bool, error) {
+	var count int64
+	err := db.Model(&Workout{}).
+		Where("user_id = ? AND LOWER(name) = LOWER(?) AND id <> ?", userID, name, excludeID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func getWorkouts(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		// Archived types are hidden from pickers unless asked for
+		query := db.Where("user_id = ?", user.ID)
+		if c.Query("include_archived") != "true" {
+			query = query.Where("archived = ?", false)
+		}
+
+		workouts := []Workout{}
+		if err := query.Order("id ASC").Find(&workouts).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, workouts)
+	}
+}
+
+// findOrCreateWorkout returns the user's workout type called name, ignoring
+// case, and creates it if there is none. A workout type created by a
+// concurrent request is returned rather than duplicated.
+func findOrCreateWorkout(tx *gorm.DB, userID uint, name string) (*Workout, error) {
+	var workout Workout
+	err := tx.Where("user_id = ? AND LOWER(name) = LOWER(?)", userID, name).First(&workout).Error
+	if err != gorm.ErrRecordNotFound {
+		return &workout, err
+	}
+
+	workout = Workout{UserID: userID, Name: name}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&workout)
+	if result.Error != nil || result.RowsAffected > 0 {
+		return &workout, result.Error
+	}
+	err = tx.Where("user_id = ? AND LOWER(name) = LOWER(?)", userID, name).First(&workout).Error
+	return &workout, err
+}
+
+func postWorkout(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		name := strings.TrimSpace(payload.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+			return
+		}
+
+		taken, err := workoutNameTaken(db, user.ID, name, 0)
+		if err != nil {
+			internalError(c, err)
+			return
+		}
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "workout already exists"})
+			return
+		}
+
+		workout := Workout{UserID: user.ID, Name: name}
+		if err := db.Create(&workout).Error; err != nil {
+			// Another request took the name since it was checked
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				c.JSON(http.StatusConflict, gin.H{"error": "workout already exists"})
+				return
+			}
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusCreated, workout)
+	}
+}
+
+func updateWorkout(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		workout, ok := workoutForID(c, db, user)
+		if !ok {
+			return
+		}
+
+		var payload struct {
+			Name     string `json:"name"`
+			Archived *bool  `json:"archived"`
+		}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if name := strings.TrimSpace(payload.Name); name != "" {
+			taken, err := workoutNameTaken(db, user.ID, name, workout.ID)
+			if err != nil {
+				internalError(c, err)
+				return
+			}
+			if taken {
+				c.JSON(http.StatusConflict, gin.H{"error": "workout already exists"})
+				return
+			}
+			workout.Name = name
+		}
+		if payload.Archived != nil {
+			workout.Archived = *payload.Archived
+		}
+
+		if err := db.Save(workout).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				c.JSON(http.StatusConflict, gin.H{"error": "workout already exists"})
+				return
+			}
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, workout)
+	}
+}
+
+func archiveWorkout(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		db := db.WithContext(c.Request.Context())
+		user := currentUser(c)
+
+		workout, ok := workoutForID(c, db, user)
+		if !ok {
+			return
+		}
+
+		// Entries keep referencing the archived type, so history is preserved
+		if err := db.Model(workout).Update("archived", true).Error; err != nil {
+			internalError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "workout archived"})
+	}
+}